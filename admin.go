@@ -0,0 +1,115 @@
+package certmagicoss
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/aUsernameWoW/certmagic-oss/storage"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+	_ caddy.Provisioner = (*adminAPI)(nil)
+)
+
+// adminLocksPath is the base path of the lock endpoints of the admin API.
+const adminLocksPath = "/oss-storage/locks"
+
+// adminAPI is a module that serves admin endpoints to inspect the locks of
+// the OSS storage and release the locks of crashed instances:
+//
+//	GET    /oss-storage/locks        lists the locks
+//	GET    /oss-storage/locks/<key>  returns the lock on key
+//	DELETE /oss-storage/locks/<key>  forcibly releases the lock on key
+type adminAPI struct {
+	storage *storage.Storage
+}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.oss_storage",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Provision sets up the module with the storage of the config, if it is
+// an OSS storage.
+func (a *adminAPI) Provision(ctx caddy.Context) error {
+	a.storage, _ = ctx.Storage().(*storage.Storage)
+	return nil
+}
+
+// Routes returns the admin routes of the OSS storage.
+func (a *adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: adminLocksPath,
+			Handler: caddy.AdminHandlerFunc(a.handleLocks),
+		},
+		{
+			Pattern: adminLocksPath + "/",
+			Handler: caddy.AdminHandlerFunc(a.handleLocks),
+		},
+	}
+}
+
+// handleLocks routes the requests within adminLocksPath.
+func (a *adminAPI) handleLocks(w http.ResponseWriter, r *http.Request) error {
+	if a.storage == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        errors.New("the storage is not an OSS storage"),
+		}
+	}
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, adminLocksPath), "/")
+	var (
+		result any
+		err    error
+	)
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		var locks []storage.LockInfo
+		locks, err = a.storage.ListLocks(r.Context())
+		if locks == nil {
+			locks = []storage.LockInfo{}
+		}
+		result = locks
+	case key != "" && r.Method == http.MethodGet:
+		result, err = a.storage.InspectLock(r.Context(), key)
+	case key != "" && r.Method == http.MethodDelete:
+		result, err = a.storage.ForceUnlock(r.Context(), key)
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("%s is not locked", key),
+		}
+	}
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(result)
+}
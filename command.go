@@ -0,0 +1,248 @@
+package certmagicoss
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+
+	"github.com/aUsernameWoW/certmagic-oss/storage"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "oss-reencrypt",
+		Usage: "[--config <path>] [--adapter <name>] [--dry-run] [--resume-from <key>] [--state-file <path>]",
+		Short: "Re-encrypts all objects of the OSS storage under the current key",
+		Long: `
+Loads and stores again every object of the OSS storage configured in the
+Caddy config, so that it is encrypted under the current primary key of the
+keyset. Run it after rotating the keyset to be able to disable the old keys.
+Each object is locked while it is rewritten, so Caddy can keep running.
+
+--dry-run only loads and decrypts the objects, without writing them back.
+
+--resume-from skips every key up to and including the given key. The last
+processed key is printed as the command progresses.
+
+--state-file records the last processed key in the given file and resumes
+from it when the command is run again. It is removed once all objects have
+been processed.
+`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.Flags().StringP("config", "c", "", "Configuration file")
+			cmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+			cmd.Flags().Bool("dry-run", false, "Only decrypt the objects, do not rewrite them")
+			cmd.Flags().String("resume-from", "", "Skip keys up to and including this key")
+			cmd.Flags().String("state-file", "", "File recording the progress, to resume from")
+			cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdReEncrypt)
+		},
+	})
+
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "oss-locks",
+		Usage: "[--config <path>] [--adapter <name>] [--json] [list | inspect <key> | unlock <key>]",
+		Short: "Lists, inspects or forcibly releases the locks of the OSS storage",
+		Long: `
+Manages the locks held in the OSS storage configured in the Caddy config,
+e.g. after an instance crashed while it was obtaining a certificate.
+
+list (the default) lists the locks with their owner and expiry.
+
+inspect <key> shows the lock on the given key.
+
+unlock <key> releases the lock on the given key whoever holds it. If its
+holder is still running, it loses the lock.
+
+--json prints the locks as JSON.
+
+The same operations are available from the admin API of a running Caddy
+at /oss-storage/locks.
+`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.Flags().StringP("config", "c", "", "Configuration file")
+			cmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+			cmd.Flags().Bool("json", false, "Print the locks as JSON")
+			cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdLocks)
+		},
+	})
+}
+
+func cmdReEncrypt(fl caddycmd.Flags) (int, error) {
+	s, err := storageFromConfig(fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	stateFile := fl.String("state-file")
+	startAfter := fl.String("resume-from")
+	if startAfter == "" && stateFile != "" {
+		state, err := os.ReadFile(stateFile)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("reading state file: %w", err)
+		}
+		startAfter = strings.TrimSpace(string(state))
+	}
+	if startAfter != "" {
+		fmt.Fprintf(os.Stderr, "resuming after %s\n", startAfter)
+	}
+
+	progress, err := s.ReEncrypt(context.Background(), storage.ReEncryptOptions{
+		StartAfter: startAfter,
+		DryRun:     fl.Bool("dry-run"),
+		Progress: func(p storage.ReEncryptProgress) {
+			fmt.Fprintf(os.Stderr, "[%d/%d] %s\n", p.Processed, p.Total, p.LastKey)
+			if stateFile != "" {
+				if err := os.WriteFile(stateFile, []byte(p.LastKey+"\n"), 0o600); err != nil {
+					fmt.Fprintf(os.Stderr, "writing state file: %v\n", err)
+				}
+			}
+		},
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, fmt.Errorf("re-encryption stopped after %q (resume with --resume-from): %w", progress.LastKey, err)
+	}
+
+	if stateFile != "" {
+		_ = os.Remove(stateFile)
+	}
+	verb := "re-encrypted"
+	if fl.Bool("dry-run") {
+		verb = "verified"
+	}
+	fmt.Fprintf(os.Stderr, "%s %d objects\n", verb, progress.Processed)
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdLocks(fl caddycmd.Flags) (int, error) {
+	action, key := "list", ""
+	switch args := fl.Args(); len(args) {
+	case 0:
+	case 1:
+		action = args[0]
+	case 2:
+		action, key = args[0], args[1]
+	default:
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("too many arguments: %v", args)
+	}
+	if (action == "list") != (key == "") {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("usage: oss-locks [list | inspect <key> | unlock <key>]")
+	}
+
+	s, err := storageFromConfig(fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	ctx := context.Background()
+	var locks []storage.LockInfo
+	switch action {
+	case "list":
+		locks, err = s.ListLocks(ctx)
+	case "inspect":
+		var lock storage.LockInfo
+		lock, err = s.InspectLock(ctx, key)
+		locks = append(locks, lock)
+	case "unlock":
+		var lock storage.LockInfo
+		lock, err = s.ForceUnlock(ctx, key)
+		locks = append(locks, lock)
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "released lock on %s\n", key)
+		}
+	default:
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("unknown action %q", action)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return caddy.ExitCodeFailedQuit, fmt.Errorf("%s is not locked", key)
+	}
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+
+	if fl.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if locks == nil {
+			locks = []storage.LockInfo{}
+		}
+		if err := enc.Encode(locks); err != nil {
+			return caddy.ExitCodeFailedQuit, err
+		}
+		return caddy.ExitCodeSuccess, nil
+	}
+	if err := printLocks(os.Stdout, locks); err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// printLocks prints locks as a table.
+func printLocks(w io.Writer, locks []storage.LockInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tOWNER\tFENCE\tACQUIRED\tEXPIRES\tSTATE")
+	for _, lock := range locks {
+		owner := lock.Owner
+		if owner == "" {
+			owner = "-"
+		}
+		state := "held"
+		if lock.Expired {
+			state = "expired"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", lock.Key, owner, lock.Fence,
+			lock.AcquiredAt.Format(time.RFC3339), lock.ExpiresAt.Format(time.RFC3339), state)
+	}
+	return tw.Flush()
+}
+
+// storageFromConfig loads the Caddy config from configFile and returns the
+// OSS storage it configures.
+func storageFromConfig(configFile, adapter string) (*storage.Storage, error) {
+	cfgJSON, _, err := caddycmd.LoadConfig(configFile, adapter)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg caddy.Config
+	if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+		return nil, fmt.Errorf("decoding config: %w", err)
+	}
+	if len(cfg.StorageRaw) == 0 {
+		return nil, errors.New("the config does not define a storage")
+	}
+
+	var module struct {
+		Module string `json:"module"`
+	}
+	if err := json.Unmarshal(cfg.StorageRaw, &module); err != nil {
+		return nil, fmt.Errorf("decoding storage config: %w", err)
+	}
+	if module.Module != "oss" {
+		return nil, fmt.Errorf("the config uses the %q storage, not oss", module.Module)
+	}
+
+	var s CaddyStorageOSS
+	if err := json.Unmarshal(cfg.StorageRaw, &s); err != nil {
+		return nil, fmt.Errorf("decoding storage config: %w", err)
+	}
+	s.logger = caddy.Log()
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	cms, err := s.CertMagicStorage()
+	if err != nil {
+		return nil, err
+	}
+	return cms.(*storage.Storage), nil
+}
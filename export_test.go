@@ -0,0 +1,12 @@
+package certmagicoss
+
+import (
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/aUsernameWoW/certmagic-oss/storage"
+)
+
+// NewAdminAPI returns the admin API module serving the locks of s.
+func NewAdminAPI(s *storage.Storage) caddy.AdminRouter {
+	return &adminAPI{storage: s}
+}
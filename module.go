@@ -4,41 +4,188 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss/credentials"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/certmagic"
 	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/core/registry"
 	"github.com/google/tink/go/insecurecleartextkeyset"
 	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+	"go.uber.org/zap"
 
 	"github.com/aUsernameWoW/certmagic-oss/storage"
 )
 
 // Interface guards
 var (
+	_ caddy.Provisioner      = (*CaddyStorageOSS)(nil)
+	_ caddy.CleanerUpper     = (*CaddyStorageOSS)(nil)
 	_ caddyfile.Unmarshaler  = (*CaddyStorageOSS)(nil)
 	_ caddy.StorageConverter = (*CaddyStorageOSS)(nil)
 )
 
+// Credential modes supported by CaddyStorageOSS.
+const (
+	credentialModeDefault    = "default"
+	credentialModeStatic     = "static"
+	credentialModeProcess    = "process"
+	credentialModeECSRAMRole = "ecs-ram-role"
+	credentialModeOIDC       = "oidc"
+)
+
+// Encryption modes supported by CaddyStorageOSS.
+const (
+	encryptionModeDirect   = "direct"
+	encryptionModeEnvelope = "envelope"
+)
+
+// bucketCheckTimeout bounds the startup checks of the bucket configuration.
+const bucketCheckTimeout = 10 * time.Second
+
+// Cleartext migration modes supported by CaddyStorageOSS.
+const (
+	cleartextMigrationOff     = "off"
+	cleartextMigrationRead    = "read"
+	cleartextMigrationRewrite = "rewrite"
+)
+
 // CaddyStorageOSS implements a caddy storage backend for Alibaba Cloud OSS.
 type CaddyStorageOSS struct {
 	// BucketName is the name of the storage bucket.
 	BucketName string `json:"bucket-name"`
+	// Prefix is prepended to every key (e.g. "production/"), so that
+	// several deployments can share the bucket. Locks are scoped by it too.
+	Prefix string `json:"prefix,omitempty"`
 	// Region is the OSS region.
 	Region string `json:"region"`
 	// Endpoint is the OSS endpoint.
 	Endpoint string `json:"endpoint"`
+	// CredentialMode selects where OSS credentials come from: "default"
+	// (the OSS_ACCESS_KEY_ID, OSS_ACCESS_KEY_SECRET and OSS_SESSION_TOKEN
+	// environment variables, then the Alibaba Cloud CLI credentials file,
+	// then the access keys below), "static" (only the access keys below),
+	// "process" (credential-process), "ecs-ram-role"
+	// (the ECS instance metadata service) or "oidc" (an OIDC token
+	// exchanged through STS AssumeRoleWithOIDC, as used by RRSA). Defaults
+	// to "process" when credential-process is set and "default" otherwise.
+	CredentialMode string `json:"credential-mode,omitempty"`
 	// AccessKeyID is the access key ID for OSS.
 	AccessKeyID string `json:"access-key-id"`
 	// AccessKeySecret is the access key secret for OSS.
 	AccessKeySecret string `json:"access-key-secret"`
+	// SecurityToken is the STS security token used with temporary
+	// access keys.
+	SecurityToken string `json:"security-token,omitempty"`
+	// CredentialProcess is a command printing STS credentials as JSON
+	// (AccessKeyId, AccessKeySecret, SecurityToken, Expiration). It is run
+	// again whenever the credentials are about to expire.
+	CredentialProcess string `json:"credential-process,omitempty"`
+	// CredentialsFile is the Alibaba Cloud CLI configuration file read in
+	// "default" mode. Defaults to ~/.alibabacloud/config.json.
+	CredentialsFile string `json:"credentials-file,omitempty"`
+	// Profile is the profile of the credentials file to use. Defaults to the
+	// ALIBABA_CLOUD_PROFILE environment variable, then the current profile.
+	Profile string `json:"profile,omitempty"`
+	// ECSRAMRoleName is the RAM role attached to the ECS instance. If empty,
+	// the role is discovered from the instance metadata service.
+	ECSRAMRoleName string `json:"ecs-ram-role-name,omitempty"`
+	// OIDCRoleARN is the RAM role assumed in "oidc" mode. Defaults to the
+	// ALIBABA_CLOUD_ROLE_ARN environment variable.
+	OIDCRoleARN string `json:"oidc-role-arn,omitempty"`
+	// OIDCProviderARN is the OIDC identity provider used in "oidc" mode.
+	// Defaults to the ALIBABA_CLOUD_OIDC_PROVIDER_ARN environment variable.
+	OIDCProviderARN string `json:"oidc-provider-arn,omitempty"`
+	// OIDCTokenFile is the OIDC token file used in "oidc" mode. Defaults to
+	// the ALIBABA_CLOUD_OIDC_TOKEN_FILE environment variable.
+	OIDCTokenFile string `json:"oidc-token-file,omitempty"`
+	// RoleSessionName is the STS session name used in "oidc" mode.
+	RoleSessionName string `json:"role-session-name,omitempty"`
+	// STSEndpoint is the STS endpoint used in "oidc" mode. Defaults to
+	// sts.aliyuncs.com.
+	STSEndpoint string `json:"sts-endpoint,omitempty"`
+	// CredentialsRefreshWindow is the duration (e.g. "5m") before expiry at
+	// which temporary credentials are refreshed. Defaults to 5 minutes.
+	CredentialsRefreshWindow string `json:"credentials-refresh-window,omitempty"`
 	// EncryptionKeySet is the path of a json tink encryption keyset
 	EncryptionKeySet string `json:"encryption-key-set"`
+	// EncryptionKeySetKMSURI is the URI of the KMS key the keyset is
+	// encrypted with. If empty, the keyset is read in cleartext. The KMS
+	// client for the URI must be registered with Tink's
+	// registry.RegisterKMSClient.
+	EncryptionKeySetKMSURI string `json:"encryption-key-set-kms-uri,omitempty"`
+	// EncryptionMode is either "direct" (the default), encrypting every
+	// object with the keyset, or "envelope", encrypting every object with its
+	// own data key wrapped by the keyset (or directly by the KMS key when no
+	// keyset is configured).
+	EncryptionMode string `json:"encryption-mode,omitempty"`
+	// CleartextMigration controls how objects stored in cleartext, e.g.
+	// before encryption was enabled, are loaded: "off" (the default) refuses
+	// them, "read" returns them as is and "rewrite" also stores them again,
+	// encrypted.
+	CleartextMigration string `json:"cleartext-migration,omitempty"`
+	// ServerSideEncryption makes OSS encrypt the objects at rest: "AES256"
+	// (SSE-OSS) or "KMS" (SSE-KMS). It can be combined with client side
+	// encryption.
+	ServerSideEncryption string `json:"server-side-encryption,omitempty"`
+	// ServerSideEncryptionKeyID is the KMS key ID used by SSE-KMS. Defaults
+	// to the key managed by OSS.
+	ServerSideEncryptionKeyID string `json:"server-side-encryption-key-id,omitempty"`
 	// LockExpiration is the duration (e.g. "5m", "10m") before a distributed
 	// lock is considered expired. Defaults to 5 minutes.
 	LockExpiration string `json:"lock-expiration,omitempty"`
+	// LockRenewInterval is the interval (e.g. "1m") at which the leases of
+	// the locks held are renewed. Defaults to a third of lock-expiration;
+	// "0" disables the renewal.
+	LockRenewInterval string `json:"lock-renew-interval,omitempty"`
+	// LockPollInterval is the initial interval (e.g. "1s") between two
+	// checks of a lock held by another instance. Defaults to 1 second.
+	LockPollInterval string `json:"lock-poll-interval,omitempty"`
+	// LockPollMaxInterval is the maximum interval (e.g. "10s") between two
+	// checks of a lock. Defaults to 10 seconds.
+	LockPollMaxInterval string `json:"lock-poll-max-interval,omitempty"`
+	// LockPollMultiplier is the factor (e.g. "2") by which the interval
+	// between two checks of a lock grows. Defaults to 2.
+	LockPollMultiplier string `json:"lock-poll-multiplier,omitempty"`
+	// LockPollJitter is the fraction (e.g. "0.2") by which the intervals
+	// between two checks of a lock are randomly shortened or lengthened.
+	// Defaults to 0.2; "0" disables the jitter.
+	LockPollJitter string `json:"lock-poll-jitter,omitempty"`
+	// LockMaxWait is the maximum duration (e.g. "10m") to wait for a lock
+	// held by another instance. Defaults to waiting as long as CertMagic
+	// does.
+	LockMaxWait string `json:"lock-max-wait,omitempty"`
+	// LockReapInterval is the interval (e.g. "10m") at which the locks left
+	// behind by crashed instances, and those released under lock-prefix, are
+	// deleted. Disabled by default.
+	LockReapInterval string `json:"lock-reap-interval,omitempty"`
+	// LockReapMargin is the duration (e.g. "5m") after their expiry, or
+	// their release under lock-prefix, after which lock objects are deleted
+	// by the reaper. Defaults to lock-expiration.
+	LockReapMargin string `json:"lock-reap-margin,omitempty"`
+	// LockPrefix is the prefix of the lock objects (e.g. "locks/"), to keep
+	// them apart from the certificates. Defaults to storing the lock of a
+	// key next to it.
+	LockPrefix string `json:"lock-prefix,omitempty"`
+	// LegacyLocks makes locks also hold the lock objects next to their key,
+	// which instances without lock-prefix use, during a rolling upgrade.
+	// Requires LockPrefix.
+	LegacyLocks bool `json:"legacy-locks,omitempty"`
+	// InstanceID identifies this Caddy instance as the owner of the locks it
+	// holds. Defaults to the hostname and process ID.
+	InstanceID string `json:"instance-id,omitempty"`
+
+	logger *zap.Logger
+
+	// reaperCtx is done when the module is cleaned up, reaperDone is
+	// closed once the reaper stopped.
+	reaperCtx  context.Context
+	stopReaper context.CancelFunc
+	reaperDone chan struct{}
 }
 
 func init() {
@@ -55,52 +202,304 @@ func (CaddyStorageOSS) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// Provision sets up the module.
+func (s *CaddyStorageOSS) Provision(ctx caddy.Context) error {
+	s.logger = ctx.Logger()
+	s.reaperCtx, s.stopReaper = context.WithCancel(ctx)
+	return nil
+}
+
+// Cleanup stops the lock reaper.
+func (s *CaddyStorageOSS) Cleanup() error {
+	if s.stopReaper != nil {
+		s.stopReaper()
+	}
+	if s.reaperDone != nil {
+		<-s.reaperDone
+	}
+	return nil
+}
+
 // CertMagicStorage returns a cert-magic storage.
 func (s *CaddyStorageOSS) CertMagicStorage() (certmagic.Storage, error) {
 	repl := caddy.NewReplacer()
 
-	var lockExp time.Duration
-	if lockStr := repl.ReplaceAll(s.LockExpiration, ""); lockStr != "" {
-		var err error
-		lockExp, err = time.ParseDuration(lockStr)
-		if err != nil {
-			return nil, fmt.Errorf("invalid lock-expiration %q: %w", lockStr, err)
-		}
+	lockExp, err := parseDuration("lock-expiration", repl.ReplaceAll(s.LockExpiration, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	renewStr := repl.ReplaceAll(s.LockRenewInterval, "")
+	renewInterval, err := parseDuration("lock-renew-interval", renewStr)
+	if err != nil {
+		return nil, err
+	}
+	if renewStr != "" && renewInterval == 0 {
+		renewInterval = -1
+	}
+
+	pollInterval, err := parseDuration("lock-poll-interval", repl.ReplaceAll(s.LockPollInterval, ""))
+	if err != nil {
+		return nil, err
+	}
+	pollMaxInterval, err := parseDuration("lock-poll-max-interval", repl.ReplaceAll(s.LockPollMaxInterval, ""))
+	if err != nil {
+		return nil, err
+	}
+	pollMultiplier, err := parseFloat("lock-poll-multiplier", repl.ReplaceAll(s.LockPollMultiplier, ""))
+	if err != nil {
+		return nil, err
+	}
+	jitterStr := repl.ReplaceAll(s.LockPollJitter, "")
+	pollJitter, err := parseFloat("lock-poll-jitter", jitterStr)
+	if err != nil {
+		return nil, err
+	}
+	if jitterStr != "" && pollJitter == 0 {
+		pollJitter = -1
+	}
+	lockMaxWait, err := parseDuration("lock-max-wait", repl.ReplaceAll(s.LockMaxWait, ""))
+	if err != nil {
+		return nil, err
+	}
+	reapInterval, err := parseDuration("lock-reap-interval", repl.ReplaceAll(s.LockReapInterval, ""))
+	if err != nil {
+		return nil, err
+	}
+	reapMargin, err := parseDuration("lock-reap-margin", repl.ReplaceAll(s.LockReapMargin, ""))
+	if err != nil {
+		return nil, err
 	}
 
 	config := storage.Config{
 		BucketName:      repl.ReplaceAll(s.BucketName, ""),
+		Prefix:          repl.ReplaceAll(s.Prefix, ""),
 		Region:          repl.ReplaceAll(s.Region, ""),
 		Endpoint:        repl.ReplaceAll(s.Endpoint, ""),
 		AccessKeyID:     repl.ReplaceAll(s.AccessKeyID, ""),
 		AccessKeySecret: repl.ReplaceAll(s.AccessKeySecret, ""),
+		SecurityToken:   repl.ReplaceAll(s.SecurityToken, ""),
+		CredentialsFile: repl.ReplaceAll(s.CredentialsFile, ""),
+		Profile:         repl.ReplaceAll(s.Profile, ""),
 		LockExpiration:  lockExp,
+		InstanceID:      repl.ReplaceAll(s.InstanceID, ""),
+		Logger:          s.logger,
+
+		LockRenewInterval:         renewInterval,
+		LockPollInterval:          pollInterval,
+		LockPollMaxInterval:       pollMaxInterval,
+		LockPollMultiplier:        pollMultiplier,
+		LockPollJitter:            pollJitter,
+		LockMaxWait:               lockMaxWait,
+		LockReapInterval:          reapInterval,
+		LockReapMargin:            reapMargin,
+		LockPrefix:                repl.ReplaceAll(s.LockPrefix, ""),
+		LegacyLocks:               s.LegacyLocks,
+		ServerSideEncryption:      repl.ReplaceAll(s.ServerSideEncryption, ""),
+		ServerSideEncryptionKeyID: repl.ReplaceAll(s.ServerSideEncryptionKeyID, ""),
 	}
 
-	encryptionKeySet := repl.ReplaceAll(s.EncryptionKeySet, "")
+	creds, err := s.credentialsProvider(repl)
+	if err != nil {
+		return nil, err
+	}
+	config.CredentialsProvider = creds
 
-	if len(encryptionKeySet) > 0 {
-		f, err := os.Open(encryptionKeySet)
-		if err != nil {
-			return nil, err
+	kp, err := s.encryptionAEAD(repl)
+	if err != nil {
+		return nil, err
+	}
+	switch mode := repl.ReplaceAll(s.EncryptionMode, ""); mode {
+	case "", encryptionModeDirect:
+		config.AEAD = kp
+	case encryptionModeEnvelope:
+		if kp == nil {
+			return nil, fmt.Errorf("envelope encryption requires encryption-key-set or encryption-key-set-kms-uri")
 		}
-		defer f.Close()
+		config.KEK = kp
+	default:
+		return nil, fmt.Errorf("unknown encryption-mode %q", mode)
+	}
+	switch mode := repl.ReplaceAll(s.CleartextMigration, ""); mode {
+	case "", cleartextMigrationOff:
+	case cleartextMigrationRead:
+		config.MigrateCleartext = true
+	case cleartextMigrationRewrite:
+		config.MigrateCleartext = true
+		config.RewriteCleartext = true
+	default:
+		return nil, fmt.Errorf("unknown cleartext-migration %q", mode)
+	}
 
-		r := keyset.NewJSONReader(f)
-		// TODO: Add the ability to read an encrypted keyset / or envelope encryption
-		// see https://github.com/google/tink/blob/e5c9356ed471be08a63eb5ea3ad0e892544e5a1c/go/keyset/handle_test.go#L84-L86
-		// or https://github.com/google/tink/blob/master/docs/GOLANG-HOWTO.md
-		kh, err := insecurecleartextkeyset.Read(r)
+	st, err := storage.NewStorage(context.Background(), config)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), bucketCheckTimeout)
+	defer cancel()
+	st.CheckBucketEncryption(ctx)
+	s.startReaper(st)
+	return st, nil
+}
+
+// startReaper runs the lock reaper of st in the background until the module
+// is cleaned up, if the module was provisioned and the reaper is enabled. It
+// is only started once.
+func (s *CaddyStorageOSS) startReaper(st *storage.Storage) {
+	if s.reaperCtx == nil || s.reaperDone != nil || s.LockReapInterval == "" {
+		return
+	}
+	done := make(chan struct{})
+	s.reaperDone = done
+	go func() {
+		defer close(done)
+		st.RunReaper(s.reaperCtx)
+	}()
+}
+
+// parseDuration parses the duration value of option, or returns zero if
+// value is empty.
+func parseDuration(option, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", option, value, err)
+	}
+	return d, nil
+}
+
+// parseFloat parses the number value of option, or returns zero if value is
+// empty.
+func parseFloat(option, value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", option, value, err)
+	}
+	return f, nil
+}
+
+// credentialsProvider returns the provider for the configured credential
+// mode, or nil when the storage should resolve the default credential chain.
+func (s *CaddyStorageOSS) credentialsProvider(repl *caddy.Replacer) (credentials.CredentialsProvider, error) {
+	var fetch storage.CredentialsFetcher
+	switch mode := s.credentialMode(); mode {
+	case credentialModeDefault:
+		return nil, nil
+	case credentialModeStatic:
+		return credentials.NewStaticCredentialsProvider(
+			repl.ReplaceAll(s.AccessKeyID, ""),
+			repl.ReplaceAll(s.AccessKeySecret, ""),
+			repl.ReplaceAll(s.SecurityToken, ""),
+		), nil
+	case credentialModeProcess:
+		fetch = storage.NewProcessCredentialsFetcher(repl.ReplaceAll(s.CredentialProcess, ""))
+	case credentialModeECSRAMRole:
+		fetch = storage.NewECSRoleCredentialsFetcher(storage.ECSRoleConfig{
+			RoleName: repl.ReplaceAll(s.ECSRAMRoleName, ""),
+		})
+	case credentialModeOIDC:
+		fetch = storage.NewOIDCRoleCredentialsFetcher(storage.OIDCRoleConfig{
+			RoleARN:         repl.ReplaceAll(s.OIDCRoleARN, ""),
+			OIDCProviderARN: repl.ReplaceAll(s.OIDCProviderARN, ""),
+			TokenFile:       repl.ReplaceAll(s.OIDCTokenFile, ""),
+			RoleSessionName: repl.ReplaceAll(s.RoleSessionName, ""),
+			STSEndpoint:     repl.ReplaceAll(s.STSEndpoint, ""),
+		})
+	default:
+		return nil, fmt.Errorf("unknown credential-mode %q", mode)
+	}
+
+	var refreshWindow time.Duration
+	if windowStr := repl.ReplaceAll(s.CredentialsRefreshWindow, ""); windowStr != "" {
+		var err error
+		refreshWindow, err = time.ParseDuration(windowStr)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("invalid credentials-refresh-window %q: %w", windowStr, err)
 		}
-		kp, err := aead.New(kh)
-		if err != nil {
-			return nil, err
+	}
+	return storage.NewRefreshingCredentialsProvider(fetch, refreshWindow), nil
+}
+
+// credentialMode returns the configured credential mode, applying defaults.
+func (s *CaddyStorageOSS) credentialMode() string {
+	if s.CredentialMode != "" {
+		return s.CredentialMode
+	}
+	if s.CredentialProcess != "" {
+		return credentialModeProcess
+	}
+	return credentialModeDefault
+}
+
+// encryptionAEAD returns the AEAD of the configured keyset, or nil if
+// client-side encryption is disabled. In envelope mode without a keyset, the
+// KMS AEAD itself is returned to be used as the key encryption key.
+func (s *CaddyStorageOSS) encryptionAEAD(repl *caddy.Replacer) (tink.AEAD, error) {
+	encryptionKeySet := repl.ReplaceAll(s.EncryptionKeySet, "")
+	kmsURI := repl.ReplaceAll(s.EncryptionKeySetKMSURI, "")
+
+	if len(encryptionKeySet) == 0 {
+		if kmsURI == "" {
+			return nil, nil
 		}
-		config.AEAD = kp
+		if repl.ReplaceAll(s.EncryptionMode, "") != encryptionModeEnvelope {
+			// Storing the certificates in cleartext would be a surprise
+			return nil, fmt.Errorf("encryption-key-set-kms-uri requires encryption-key-set, or encryption-mode %s", encryptionModeEnvelope)
+		}
+		return kmsAEAD(kmsURI)
 	}
-	return storage.NewStorage(context.Background(), config)
+
+	f, err := os.Open(encryptionKeySet)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := keyset.NewJSONReader(f)
+	var kh *keyset.Handle
+	if kmsURI != "" {
+		kh, err = readEncryptedKeyset(r, kmsURI)
+	} else {
+		kh, err = insecurecleartextkeyset.Read(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return aead.New(kh)
+}
+
+// kmsAEAD returns the AEAD of the KMS key identified by kmsURI. The KMS
+// client supporting kmsURI must have been registered with
+// registry.RegisterKMSClient, e.g. by a plugin providing the KMS integration.
+func kmsAEAD(kmsURI string) (tink.AEAD, error) {
+	client, err := registry.GetKMSClient(kmsURI)
+	if err != nil {
+		return nil, fmt.Errorf("finding KMS client for %s: %w", kmsURI, err)
+	}
+	kp, err := client.GetAEAD(kmsURI)
+	if err != nil {
+		return nil, fmt.Errorf("getting KMS AEAD for %s: %w", kmsURI, err)
+	}
+	return kp, nil
+}
+
+// readEncryptedKeyset reads a keyset encrypted under the KMS key identified
+// by kmsURI.
+func readEncryptedKeyset(r keyset.Reader, kmsURI string) (*keyset.Handle, error) {
+	masterKey, err := kmsAEAD(kmsURI)
+	if err != nil {
+		return nil, err
+	}
+	kh, err := keyset.Read(r, masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting keyset with %s: %w", kmsURI, err)
+	}
+	return kh, nil
 }
 
 // Validate caddy oss storage configuration.
@@ -111,11 +510,25 @@ func (s *CaddyStorageOSS) Validate() error {
 	if s.Region == "" {
 		return fmt.Errorf("region must be defined")
 	}
-	if s.AccessKeyID == "" {
-		return fmt.Errorf("access key id must be defined")
-	}
-	if s.AccessKeySecret == "" {
-		return fmt.Errorf("access key secret must be defined")
+	switch mode := s.credentialMode(); mode {
+	case credentialModeDefault:
+		if (s.AccessKeyID == "") != (s.AccessKeySecret == "") {
+			return fmt.Errorf("access key id and access key secret must be defined together")
+		}
+	case credentialModeStatic:
+		if s.AccessKeyID == "" {
+			return fmt.Errorf("access key id must be defined")
+		}
+		if s.AccessKeySecret == "" {
+			return fmt.Errorf("access key secret must be defined")
+		}
+	case credentialModeProcess:
+		if s.CredentialProcess == "" {
+			return fmt.Errorf("credential process must be defined")
+		}
+	case credentialModeECSRAMRole, credentialModeOIDC:
+	default:
+		return fmt.Errorf("unknown credential mode %q", mode)
 	}
 	return nil
 }
@@ -133,6 +546,8 @@ func (s *CaddyStorageOSS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		switch key {
 		case "bucket-name":
 			s.BucketName = value
+		case "prefix":
+			s.Prefix = value
 		case "region":
 			s.Region = value
 		case "endpoint":
@@ -141,10 +556,70 @@ func (s *CaddyStorageOSS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			s.AccessKeyID = value
 		case "access-key-secret":
 			s.AccessKeySecret = value
+		case "security-token":
+			s.SecurityToken = value
+		case "credential-mode":
+			s.CredentialMode = value
+		case "credentials-file":
+			s.CredentialsFile = value
+		case "profile":
+			s.Profile = value
+		case "ecs-ram-role-name":
+			s.ECSRAMRoleName = value
+		case "oidc-role-arn":
+			s.OIDCRoleARN = value
+		case "oidc-provider-arn":
+			s.OIDCProviderARN = value
+		case "oidc-token-file":
+			s.OIDCTokenFile = value
+		case "role-session-name":
+			s.RoleSessionName = value
+		case "sts-endpoint":
+			s.STSEndpoint = value
+		case "credential-process":
+			s.CredentialProcess = value
+		case "credentials-refresh-window":
+			s.CredentialsRefreshWindow = value
 		case "encryption-key-set":
 			s.EncryptionKeySet = value
+		case "encryption-key-set-kms-uri":
+			s.EncryptionKeySetKMSURI = value
+		case "encryption-mode":
+			s.EncryptionMode = value
+		case "cleartext-migration":
+			s.CleartextMigration = value
+		case "server-side-encryption":
+			s.ServerSideEncryption = value
+		case "server-side-encryption-key-id":
+			s.ServerSideEncryptionKeyID = value
 		case "lock-expiration":
 			s.LockExpiration = value
+		case "lock-renew-interval":
+			s.LockRenewInterval = value
+		case "lock-poll-interval":
+			s.LockPollInterval = value
+		case "lock-poll-max-interval":
+			s.LockPollMaxInterval = value
+		case "lock-poll-multiplier":
+			s.LockPollMultiplier = value
+		case "lock-poll-jitter":
+			s.LockPollJitter = value
+		case "lock-max-wait":
+			s.LockMaxWait = value
+		case "lock-reap-interval":
+			s.LockReapInterval = value
+		case "lock-reap-margin":
+			s.LockReapMargin = value
+		case "lock-prefix":
+			s.LockPrefix = value
+		case "legacy-locks":
+			legacy, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid legacy-locks %q: %v", value, err)
+			}
+			s.LegacyLocks = legacy
+		case "instance-id":
+			s.InstanceID = value
 		}
 	}
 	return nil
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+var (
+	// DefaultLockPollMaxInterval is the default maximum interval between
+	// two checks of a lock held by another holder.
+	DefaultLockPollMaxInterval = 10 * time.Second
+	// DefaultLockPollMultiplier is the default factor by which the interval
+	// between two checks of a lock grows.
+	DefaultLockPollMultiplier = 2.0
+	// DefaultLockPollJitter is the default fraction by which the interval
+	// between two checks of a lock is randomly shortened or lengthened.
+	DefaultLockPollJitter = 0.2
+)
+
+// ErrLockWaitTimeout is returned by Lock when the lock could not be
+// acquired within the maximum wait of the Config.
+var ErrLockWaitTimeout = errors.New("timed out waiting for lock")
+
+// lockBackoff is the policy of Lock for polling a lock held by another
+// holder: the interval between two checks grows exponentially, with jitter
+// so that the instances waiting for a lock do not poll it in lockstep. Zero
+// values select the defaults.
+type lockBackoff struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+	jitter     float64 // negative disables the jitter
+	maxWait    time.Duration
+
+	// random returns a number in [0, 1). Defaults to rand.Float64.
+	random func() float64
+	// after waits for the duration to elapse. Defaults to time.After.
+	after func(time.Duration) <-chan time.Time
+}
+
+// validateLockBackoff checks the lock polling options of config.
+func validateLockBackoff(config Config) error {
+	switch {
+	case config.LockPollInterval < 0:
+		return fmt.Errorf("LockPollInterval must not be negative")
+	case config.LockPollMaxInterval < 0:
+		return fmt.Errorf("LockPollMaxInterval must not be negative")
+	case config.LockPollMultiplier != 0 && config.LockPollMultiplier < 1:
+		return fmt.Errorf("LockPollMultiplier must be at least 1, got %g", config.LockPollMultiplier)
+	case config.LockPollJitter > 1:
+		return fmt.Errorf("LockPollJitter must be at most 1, got %g", config.LockPollJitter)
+	case config.LockMaxWait < 0:
+		return fmt.Errorf("LockMaxWait must not be negative")
+	}
+	return nil
+}
+
+// interval returns the interval to wait before the check following the
+// given number of failed attempts to acquire a lock.
+func (b lockBackoff) interval(attempt int) time.Duration {
+	initial := b.initial
+	if initial == 0 {
+		initial = LockPollInterval
+	}
+	maxInterval := b.max
+	if maxInterval == 0 {
+		maxInterval = DefaultLockPollMaxInterval
+	}
+	maxInterval = max(maxInterval, initial)
+	multiplier := b.multiplier
+	if multiplier == 0 {
+		multiplier = DefaultLockPollMultiplier
+	}
+
+	d := math.Min(float64(initial)*math.Pow(multiplier, float64(attempt)), float64(maxInterval))
+
+	jitter := b.jitter
+	if jitter == 0 {
+		jitter = DefaultLockPollJitter
+	}
+	if jitter > 0 {
+		random := b.random
+		if random == nil {
+			random = rand.Float64
+		}
+		d *= 1 + jitter*(2*random()-1)
+	}
+	return time.Duration(d)
+}
+
+// wait waits for d to elapse, or returns the error of ctx if it is done
+// first.
+func (b lockBackoff) wait(ctx context.Context, d time.Duration) error {
+	after := b.after
+	if after == nil {
+		after = time.After
+	}
+	select {
+	case <-after(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// schedule returns the intervals of b for the given number of attempts.
+func schedule(b lockBackoff, attempts int) []time.Duration {
+	var intervals []time.Duration
+	for attempt := 0; attempt < attempts; attempt++ {
+		intervals = append(intervals, b.interval(attempt))
+	}
+	return intervals
+}
+
+func TestLockBackoff_Interval(t *testing.T) {
+	tests := map[string]struct {
+		backoff lockBackoff
+		want    []time.Duration
+	}{
+		"defaults without jitter": {
+			lockBackoff{jitter: -1},
+			[]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second},
+		},
+		"custom": {
+			lockBackoff{initial: 100 * time.Millisecond, max: time.Second, multiplier: 3, jitter: -1},
+			[]time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond, time.Second},
+		},
+		"constant": {
+			lockBackoff{initial: 100 * time.Millisecond, multiplier: 1, jitter: -1},
+			[]time.Duration{100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond},
+		},
+		"initial above default max": {
+			lockBackoff{initial: time.Minute, jitter: -1},
+			[]time.Duration{time.Minute, time.Minute},
+		},
+		"shortest jitter": {
+			lockBackoff{initial: time.Second, jitter: 0.5, random: func() float64 { return 0 }},
+			[]time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second},
+		},
+		"median jitter": {
+			lockBackoff{initial: time.Second, jitter: 0.5, random: func() float64 { return 0.5 }},
+			[]time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		"default jitter": {
+			lockBackoff{initial: time.Second, random: func() float64 { return 0.75 }},
+			[]time.Duration{1100 * time.Millisecond, 2200 * time.Millisecond, 4400 * time.Millisecond},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.want, schedule(tt.backoff, len(tt.want)))
+		})
+	}
+}
+
+func TestLockBackoff_DeprecatedPollInterval(t *testing.T) {
+	origPoll := LockPollInterval
+	LockPollInterval = 10 * time.Millisecond
+	defer func() { LockPollInterval = origPoll }()
+
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond},
+		schedule(lockBackoff{jitter: -1}, 2))
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second},
+		schedule(lockBackoff{initial: time.Second, jitter: -1}, 2), "Config takes precedence")
+}
+
+// withFakeWait makes s wait on local instead of the wall clock, and returns
+// the waits made.
+func withFakeWait(s *Storage, local *fakeClock) *[]time.Duration {
+	var waits []time.Duration
+	s.clock.local = local.Now
+	s.lockBackoff.after = func(d time.Duration) <-chan time.Time {
+		waits = append(waits, d)
+		local.Add(d)
+		ch := make(chan time.Time, 1)
+		ch <- local.Now()
+		return ch
+	}
+	return &waits
+}
+
+func TestLock_BackoffSchedule(t *testing.T) {
+	a, server := setupTestStorage(t)
+	b := connectTestStorage(t, server, "instance-b")
+	b.lockBackoff = lockBackoff{
+		initial:    time.Second,
+		max:        4 * time.Second,
+		multiplier: 2,
+		jitter:     -1,
+		maxWait:    10 * time.Second,
+	}
+	waits := withFakeWait(b, newFakeClock())
+	ctx := context.Background()
+
+	require.NoError(t, a.Lock(ctx, "example.com"))
+	err := b.Lock(ctx, "example.com")
+	assert.ErrorIs(t, err, ErrLockWaitTimeout)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 3 * time.Second}, *waits,
+		"the last wait is cut to the maximum wait")
+
+	// Once the lock is released, b acquires it at the next check.
+	*waits = nil
+	b.lockBackoff.after = func(d time.Duration) <-chan time.Time {
+		*waits = append(*waits, d)
+		if len(*waits) == 2 {
+			require.NoError(t, a.Unlock(ctx, "example.com"))
+		}
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	}
+	require.NoError(t, b.Lock(ctx, "example.com"))
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, *waits)
+}
+
+func TestLock_BackoffJitterDesynchronizes(t *testing.T) {
+	a, server := setupTestStorage(t)
+	ctx := context.Background()
+	require.NoError(t, a.Lock(ctx, "example.com"))
+
+	var schedules [][]time.Duration
+	for _, r := range []float64{0.1, 0.9} {
+		s := connectTestStorage(t, server, "waiter")
+		s.lockBackoff = lockBackoff{
+			initial: time.Second,
+			maxWait: 5 * time.Second,
+			random:  func() float64 { return r },
+		}
+		waits := withFakeWait(s, newFakeClock())
+		assert.ErrorIs(t, s.Lock(ctx, "example.com"), ErrLockWaitTimeout)
+		schedules = append(schedules, *waits)
+	}
+	assert.Equal(t, []time.Duration{840 * time.Millisecond, 1680 * time.Millisecond, 2480 * time.Millisecond}, schedules[0])
+	assert.Equal(t, []time.Duration{1160 * time.Millisecond, 2320 * time.Millisecond, 1520 * time.Millisecond}, schedules[1])
+}
+
+func TestLock_ContextDoneWhileWaiting(t *testing.T) {
+	a, server := setupTestStorage(t)
+	b := connectTestStorage(t, server, "instance-b")
+	b.lockBackoff.initial = time.Hour
+	ctx := context.Background()
+	require.NoError(t, a.Lock(ctx, "example.com"))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, b.Lock(timeoutCtx, "example.com"), context.DeadlineExceeded)
+}
+
+func TestNewStorage_LockBackoffValidation(t *testing.T) {
+	tests := map[string]struct {
+		config  Config
+		wantErr bool
+	}{
+		"defaults":            {Config{}, false},
+		"custom":              {Config{LockPollInterval: time.Second, LockPollMaxInterval: time.Minute, LockPollMultiplier: 1.5, LockPollJitter: 0.3, LockMaxWait: time.Hour}, false},
+		"jitter disabled":     {Config{LockPollJitter: -1}, false},
+		"negative interval":   {Config{LockPollInterval: -time.Second}, true},
+		"negative max":        {Config{LockPollMaxInterval: -time.Second}, true},
+		"shrinking intervals": {Config{LockPollMultiplier: 0.5}, true},
+		"jitter above 1":      {Config{LockPollJitter: 1.5}, true},
+		"negative max wait":   {Config{LockMaxWait: -time.Second}, true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			tt.config.AccessKeyID = "test-ak"
+			tt.config.AccessKeySecret = "test-sk"
+			_, err := NewStorage(context.Background(), tt.config)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
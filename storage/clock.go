@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+)
+
+// serverClock estimates the current time of the OSS server from the Date
+// header of its responses, so that the expiry of locks written and checked
+// by different hosts does not depend on their local clocks.
+type serverClock struct {
+	// local returns the local time. Defaults to time.Now.
+	local func() time.Time
+
+	mu     sync.Mutex
+	offset time.Duration // server time minus local time
+	synced bool
+}
+
+// localNow returns the local time.
+func (c *serverClock) localNow() time.Time {
+	if c.local != nil {
+		return c.local()
+	}
+	return time.Now()
+}
+
+// observe updates the estimated offset of the server clock from the Date
+// header of a response, and returns the server time it carries, or the zero
+// time without a Date header.
+func (c *serverClock) observe(header http.Header) time.Time {
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return time.Time{}
+	}
+	// Date is truncated to the second: on average, the server time is half
+	// a second later.
+	offset := date.Add(500 * time.Millisecond).Sub(c.localNow())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offset = offset
+	c.synced = true
+	return date
+}
+
+// observeErr is observe for the response of a failed request.
+func (c *serverClock) observeErr(err error) time.Time {
+	var serviceErr *oss.ServiceError
+	if errors.As(err, &serviceErr) && serviceErr.Headers != nil {
+		return c.observe(serviceErr.Headers)
+	}
+	return time.Time{}
+}
+
+// isSynced reports whether the server time was observed at least once.
+func (c *serverClock) isSynced() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.synced
+}
+
+// now returns the estimated current time of the server, or the local time
+// until a response was observed.
+func (c *serverClock) now() time.Time {
+	c.mu.Lock()
+	offset := c.offset
+	c.mu.Unlock()
+	return c.localNow().Add(offset).UTC()
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock which only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// setupSkewedStorages returns two storages whose local clock is local,
+// sharing a mock OSS server whose clock is skew ahead of local.
+func setupSkewedStorages(t *testing.T, local *fakeClock, skew time.Duration) (*Storage, *Storage) {
+	t.Helper()
+	server := mockOSSServerWithClock(t, func() time.Time { return local.Now().Add(skew) })
+	t.Cleanup(server.Close)
+
+	var storages []*Storage
+	for _, id := range []string{"instance-a", "instance-b"} {
+		s := connectTestStorage(t, server, id)
+		s.clock.local = local.Now
+		s.lockExpiration = time.Minute
+		s.lockRenewInterval = -1
+		storages = append(storages, s)
+	}
+	return storages[0], storages[1]
+}
+
+func TestServerClock(t *testing.T) {
+	local := newFakeClock()
+	c := &serverClock{local: local.Now}
+	assert.False(t, c.isSynced())
+	assert.Equal(t, local.Now(), c.now(), "local time until synced")
+
+	header := http.Header{}
+	header.Set("Date", local.Now().Add(time.Hour).Format(http.TimeFormat))
+	date := c.observe(header)
+	assert.Equal(t, local.Now().Add(time.Hour), date)
+	assert.True(t, c.isSynced())
+
+	local.Add(10 * time.Second)
+	assert.Equal(t, local.Now().Add(time.Hour+500*time.Millisecond), c.now())
+
+	assert.True(t, c.observe(http.Header{}).IsZero())
+}
+
+func TestLock_ExpiryUsesServerClock(t *testing.T) {
+	origPoll := LockPollInterval
+	LockPollInterval = 10 * time.Millisecond
+	defer func() { LockPollInterval = origPoll }()
+
+	tests := map[string]time.Duration{
+		"server ahead":  time.Hour,
+		"server behind": -time.Hour,
+		"in sync":       0,
+	}
+	for name, skew := range tests {
+		t.Run(name, func(t *testing.T) {
+			local := newFakeClock()
+			a, b := setupSkewedStorages(t, local, skew)
+			ctx := context.Background()
+
+			require.NoError(t, a.Lock(ctx, "example.com"))
+			state, err := a.readLock(ctx, a.objLockName("example.com"))
+			require.NoError(t, err)
+			assert.WithinDuration(t, local.Now().Add(skew), state.record.AcquiredAt, time.Second,
+				"lock times are in server time")
+
+			// Not expired yet on the server, whatever the local clocks say.
+			local.Add(58 * time.Second)
+			timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			defer cancel()
+			assert.ErrorIs(t, b.Lock(timeoutCtx, "example.com"), context.DeadlineExceeded)
+
+			// Expired on the server.
+			local.Add(4 * time.Second)
+			timeoutCtx, cancel = context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			require.NoError(t, b.Lock(timeoutCtx, "example.com"))
+			state, err = b.readLock(ctx, b.objLockName("example.com"))
+			require.NoError(t, err)
+			assert.Equal(t, "instance-b", state.record.Owner)
+		})
+	}
+}
+
+func TestLock_LegacyLockExpiry(t *testing.T) {
+	origPoll := LockPollInterval
+	LockPollInterval = 10 * time.Millisecond
+	defer func() { LockPollInterval = origPoll }()
+
+	local := newFakeClock()
+	s, _ := setupSkewedStorages(t, local, -time.Hour)
+	ctx := context.Background()
+
+	// An empty lock object, as written by older versions, expires
+	// lockExpiration after its LastModified time.
+	_, err := s.client.PutObject(ctx, &oss.PutObjectRequest{
+		Bucket: oss.Ptr(s.bucketName),
+		Key:    oss.Ptr(s.objLockName("example.com")),
+		Body:   bytes.NewReader(nil),
+	})
+	require.NoError(t, err)
+
+	local.Add(30 * time.Second)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Lock(timeoutCtx, "example.com"), context.DeadlineExceeded)
+
+	local.Add(time.Minute)
+	timeoutCtx, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	require.NoError(t, s.Lock(timeoutCtx, "example.com"))
+}
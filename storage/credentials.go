@@ -0,0 +1,527 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss/credentials"
+	"go.uber.org/zap"
+)
+
+// DefaultCredentialsRefreshWindow is how long before expiry temporary
+// credentials are refreshed.
+var DefaultCredentialsRefreshWindow = 5 * time.Minute
+
+// CredentialsFetcher retrieves a fresh set of credentials, typically
+// short-lived STS credentials with an expiration time.
+type CredentialsFetcher func(ctx context.Context) (credentials.Credentials, error)
+
+// RefreshingCredentialsProvider is a credentials.CredentialsProvider that
+// caches the credentials returned by a CredentialsFetcher and fetches new
+// ones shortly before they expire. It is safe for concurrent use, so a
+// single provider can back a Storage for its whole lifetime.
+type RefreshingCredentialsProvider struct {
+	fetch         CredentialsFetcher
+	refreshWindow time.Duration
+	now           func() time.Time
+
+	mu     sync.Mutex
+	cached *credentials.Credentials
+}
+
+// Interface guards
+var (
+	_ credentials.CredentialsProvider = (*RefreshingCredentialsProvider)(nil)
+)
+
+// NewRefreshingCredentialsProvider returns a provider which refreshes the
+// credentials returned by fetch refreshWindow before they expire. A zero
+// refreshWindow defaults to DefaultCredentialsRefreshWindow. Credentials
+// without an expiration are fetched once and cached forever.
+func NewRefreshingCredentialsProvider(fetch CredentialsFetcher, refreshWindow time.Duration) *RefreshingCredentialsProvider {
+	if refreshWindow == 0 {
+		refreshWindow = DefaultCredentialsRefreshWindow
+	}
+	return &RefreshingCredentialsProvider{
+		fetch:         fetch,
+		refreshWindow: refreshWindow,
+		now:           time.Now,
+	}
+}
+
+// GetCredentials returns the cached credentials, fetching new ones if they
+// are missing or about to expire. If a refresh fails while the cached
+// credentials are still valid, the cached credentials are returned so that
+// a transient STS outage does not interrupt storage operations.
+func (p *RefreshingCredentialsProvider) GetCredentials(ctx context.Context) (credentials.Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if p.cached != nil && !p.expiresWithin(now, p.refreshWindow) {
+		return *p.cached, nil
+	}
+
+	creds, err := p.fetch(ctx)
+	if err == nil && (creds.AccessKeyID == "" || creds.AccessKeySecret == "") {
+		err = errors.New("fetched credentials are missing the access key id or secret")
+	}
+	if err != nil {
+		if p.cached != nil && !p.expiresWithin(now, 0) {
+			return *p.cached, nil
+		}
+		return credentials.Credentials{}, fmt.Errorf("refreshing credentials: %w", err)
+	}
+
+	p.cached = &creds
+	return creds, nil
+}
+
+// expiresWithin reports whether the cached credentials expire within d of now.
+func (p *RefreshingCredentialsProvider) expiresWithin(now time.Time, d time.Duration) bool {
+	if p.cached.Expires == nil {
+		return false
+	}
+	return !now.Add(d).Before(*p.cached.Expires)
+}
+
+// stsCredentials is the JSON representation of temporary credentials used by
+// Alibaba Cloud STS, the ECS metadata service and credential processes.
+type stsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	AccessKeySecret string `json:"AccessKeySecret"`
+	SecurityToken   string `json:"SecurityToken"`
+	Expiration      string `json:"Expiration"`
+}
+
+// credentials converts c to SDK credentials, parsing its expiration time.
+func (c stsCredentials) credentials() (credentials.Credentials, error) {
+	creds := credentials.Credentials{
+		AccessKeyID:     c.AccessKeyID,
+		AccessKeySecret: c.AccessKeySecret,
+		SecurityToken:   c.SecurityToken,
+	}
+	if c.Expiration != "" {
+		expires, err := time.Parse(time.RFC3339, c.Expiration)
+		if err != nil {
+			return creds, fmt.Errorf("parsing credentials expiration %q: %w", c.Expiration, err)
+		}
+		creds.Expires = &expires
+	}
+	return creds, nil
+}
+
+// NewProcessCredentialsFetcher returns a CredentialsFetcher which runs
+// command and parses the credentials it prints on stdout. The output must
+// be a JSON object with the AccessKeyId, AccessKeySecret, SecurityToken
+// and Expiration (RFC 3339) fields, the format used by Alibaba Cloud STS.
+func NewProcessCredentialsFetcher(command string) CredentialsFetcher {
+	return func(ctx context.Context) (credentials.Credentials, error) {
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			return credentials.Credentials{}, errors.New("credential process command is empty")
+		}
+
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return credentials.Credentials{}, fmt.Errorf("running credential process %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+		}
+
+		var out stsCredentials
+		if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+			return credentials.Credentials{}, fmt.Errorf("decoding credential process output: %w", err)
+		}
+		return out.credentials()
+	}
+}
+
+// DefaultECSMetadataEndpoint is the address of the ECS instance metadata
+// service.
+const DefaultECSMetadataEndpoint = "http://100.100.100.200"
+
+// ecsMetadataTokenTTL is the lifetime requested for metadata access tokens
+// when the instance enforces hardened (token based) metadata access.
+const ecsMetadataTokenTTL = "21600"
+
+// ECSRoleConfig configures NewECSRoleCredentialsFetcher.
+type ECSRoleConfig struct {
+	// RoleName is the RAM role attached to the ECS instance. If empty, the
+	// role is discovered from the metadata service.
+	RoleName string
+	// Endpoint is the metadata service address. Defaults to
+	// DefaultECSMetadataEndpoint.
+	Endpoint string
+	// HTTPClient is used to query the metadata service. Defaults to a client
+	// with a 5 seconds timeout.
+	HTTPClient *http.Client
+}
+
+// ecsRoleCredentials is the response of the metadata service for a RAM role.
+type ecsRoleCredentials struct {
+	stsCredentials
+	Code string `json:"Code"`
+}
+
+// NewECSRoleCredentialsFetcher returns a CredentialsFetcher which retrieves
+// the rotating STS credentials of the RAM role attached to the ECS instance
+// from the instance metadata service. Wrap it in a
+// RefreshingCredentialsProvider to cache the credentials until they are
+// about to expire.
+func NewECSRoleCredentialsFetcher(config ECSRoleConfig) CredentialsFetcher {
+	endpoint := strings.TrimSuffix(config.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = DefaultECSMetadataEndpoint
+	}
+	client := config.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+
+	return func(ctx context.Context) (credentials.Credentials, error) {
+		// Instances in hardened mode require a metadata token; in normal mode
+		// the token endpoint may be unavailable, so carry on without one.
+		token, _ := ecsMetadataRequest(ctx, client, http.MethodPut, endpoint+"/latest/api/token", "")
+
+		role := config.RoleName
+		if role == "" {
+			body, err := ecsMetadataRequest(ctx, client, http.MethodGet, endpoint+"/latest/meta-data/ram/security-credentials/", token)
+			if err != nil {
+				return credentials.Credentials{}, fmt.Errorf("discovering ECS RAM role: %w", err)
+			}
+			role = strings.TrimSpace(strings.SplitN(body, "\n", 2)[0])
+			if role == "" {
+				return credentials.Credentials{}, errors.New("no RAM role is attached to the ECS instance")
+			}
+		}
+
+		body, err := ecsMetadataRequest(ctx, client, http.MethodGet, endpoint+"/latest/meta-data/ram/security-credentials/"+role, token)
+		if err != nil {
+			return credentials.Credentials{}, fmt.Errorf("fetching credentials of ECS RAM role %s: %w", role, err)
+		}
+
+		var out ecsRoleCredentials
+		if err := json.Unmarshal([]byte(body), &out); err != nil {
+			return credentials.Credentials{}, fmt.Errorf("decoding credentials of ECS RAM role %s: %w", role, err)
+		}
+		if out.Code != "" && out.Code != "Success" {
+			return credentials.Credentials{}, fmt.Errorf("fetching credentials of ECS RAM role %s: metadata service returned %s", role, out.Code)
+		}
+		return out.credentials()
+	}
+}
+
+// ecsMetadataRequest performs a request against the ECS metadata service and
+// returns the response body. A PUT fetches a metadata token, other methods
+// send token (if any) along with the request.
+func ecsMetadataRequest(ctx context.Context, client *http.Client, method, url, token string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	if method == http.MethodPut {
+		req.Header.Set("X-aliyun-ecs-metadata-token-ttl-seconds", ecsMetadataTokenTTL)
+	} else if token != "" {
+		req.Header.Set("X-aliyun-ecs-metadata-token", token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return string(body), nil
+}
+
+// DefaultSTSEndpoint is the address of the Alibaba Cloud STS service.
+const DefaultSTSEndpoint = "https://sts.aliyuncs.com"
+
+// Environment variables set by RRSA (RAM Roles for Service Accounts) on
+// Container Service for Kubernetes (ACK) pods.
+const (
+	envRoleARN         = "ALIBABA_CLOUD_ROLE_ARN"
+	envOIDCProviderARN = "ALIBABA_CLOUD_OIDC_PROVIDER_ARN"
+	envOIDCTokenFile   = "ALIBABA_CLOUD_OIDC_TOKEN_FILE"
+)
+
+// OIDCRoleConfig configures NewOIDCRoleCredentialsFetcher. Empty RoleARN,
+// OIDCProviderARN and TokenFile fields default to the ALIBABA_CLOUD_ROLE_ARN,
+// ALIBABA_CLOUD_OIDC_PROVIDER_ARN and ALIBABA_CLOUD_OIDC_TOKEN_FILE
+// environment variables injected by RRSA.
+type OIDCRoleConfig struct {
+	// RoleARN is the ARN of the RAM role to assume.
+	RoleARN string
+	// OIDCProviderARN is the ARN of the OIDC identity provider.
+	OIDCProviderARN string
+	// TokenFile is the path of the OIDC token file. It is read on every
+	// refresh because the token is rotated by the kubelet.
+	TokenFile string
+	// RoleSessionName identifies the session. Defaults to "certmagic-oss".
+	RoleSessionName string
+	// Duration is the lifetime of the issued credentials. Defaults to the
+	// role's maximum session duration as configured in STS.
+	Duration time.Duration
+	// STSEndpoint is the STS service address. Defaults to DefaultSTSEndpoint.
+	STSEndpoint string
+	// HTTPClient is used to call STS. Defaults to a client with a 10 seconds
+	// timeout.
+	HTTPClient *http.Client
+}
+
+// assumeRoleResponse is the response of the STS AssumeRole* actions.
+type assumeRoleResponse struct {
+	RequestID   string         `json:"RequestId"`
+	Code        string         `json:"Code"`
+	Message     string         `json:"Message"`
+	Credentials stsCredentials `json:"Credentials"`
+}
+
+// NewOIDCRoleCredentialsFetcher returns a CredentialsFetcher which exchanges
+// an OIDC token, such as the projected service account token of RRSA, for
+// STS credentials using the AssumeRoleWithOIDC action. Wrap it in a
+// RefreshingCredentialsProvider to cache the credentials until they are
+// about to expire.
+func NewOIDCRoleCredentialsFetcher(config OIDCRoleConfig) CredentialsFetcher {
+	if config.RoleARN == "" {
+		config.RoleARN = os.Getenv(envRoleARN)
+	}
+	if config.OIDCProviderARN == "" {
+		config.OIDCProviderARN = os.Getenv(envOIDCProviderARN)
+	}
+	if config.TokenFile == "" {
+		config.TokenFile = os.Getenv(envOIDCTokenFile)
+	}
+	if config.RoleSessionName == "" {
+		config.RoleSessionName = "certmagic-oss"
+	}
+	endpoint := strings.TrimSuffix(config.STSEndpoint, "/")
+	if endpoint == "" {
+		endpoint = DefaultSTSEndpoint
+	}
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		endpoint = "https://" + endpoint
+	}
+	client := config.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return func(ctx context.Context) (credentials.Credentials, error) {
+		if config.RoleARN == "" || config.OIDCProviderARN == "" || config.TokenFile == "" {
+			return credentials.Credentials{}, errors.New("role ARN, OIDC provider ARN and OIDC token file must be defined")
+		}
+		token, err := os.ReadFile(config.TokenFile)
+		if err != nil {
+			return credentials.Credentials{}, fmt.Errorf("reading OIDC token: %w", err)
+		}
+
+		form := url.Values{
+			"Action":          {"AssumeRoleWithOIDC"},
+			"Format":          {"JSON"},
+			"Version":         {"2015-04-01"},
+			"Timestamp":       {time.Now().UTC().Format("2006-01-02T15:04:05Z")},
+			"RoleArn":         {config.RoleARN},
+			"OIDCProviderArn": {config.OIDCProviderARN},
+			"OIDCToken":       {strings.TrimSpace(string(token))},
+			"RoleSessionName": {config.RoleSessionName},
+		}
+		if config.Duration > 0 {
+			form.Set("DurationSeconds", fmt.Sprint(int(config.Duration.Seconds())))
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/", strings.NewReader(form.Encode()))
+		if err != nil {
+			return credentials.Credentials{}, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return credentials.Credentials{}, fmt.Errorf("calling AssumeRoleWithOIDC: %w", err)
+		}
+		defer resp.Body.Close()
+
+		var out assumeRoleResponse
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			return credentials.Credentials{}, fmt.Errorf("decoding AssumeRoleWithOIDC response (status %s): %w", resp.Status, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return credentials.Credentials{}, fmt.Errorf("calling AssumeRoleWithOIDC: %s: %s (request id %s)", out.Code, out.Message, out.RequestID)
+		}
+		return out.Credentials.credentials()
+	}
+}
+
+// Environment variables read by the default credential chain.
+const (
+	envAccessKeyID     = "OSS_ACCESS_KEY_ID"
+	envAccessKeySecret = "OSS_ACCESS_KEY_SECRET"
+	envSessionToken    = "OSS_SESSION_TOKEN"
+	envProfile         = "ALIBABA_CLOUD_PROFILE"
+)
+
+// cliConfig is the Alibaba Cloud CLI configuration file
+// (~/.alibabacloud/config.json).
+type cliConfig struct {
+	Current  string       `json:"current"`
+	Profiles []cliProfile `json:"profiles"`
+}
+
+// cliProfile is a profile of the Alibaba Cloud CLI configuration file.
+type cliProfile struct {
+	Name            string `json:"name"`
+	Mode            string `json:"mode"`
+	AccessKeyID     string `json:"access_key_id"`
+	AccessKeySecret string `json:"access_key_secret"`
+	StsToken        string `json:"sts_token"`
+	RAMRoleName     string `json:"ram_role_name"`
+	RAMRoleARN      string `json:"ram_role_arn"`
+	RoleSessionName string `json:"ram_session_name"`
+	OIDCProviderARN string `json:"oidc_provider_arn"`
+	OIDCTokenFile   string `json:"oidc_token_file"`
+}
+
+// defaultCredentialsFile returns the path of the Alibaba Cloud CLI
+// configuration file in the home directory of the current user.
+func defaultCredentialsFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".alibabacloud", "config.json")
+}
+
+// resolveCredentials returns the credentials provider for config along with
+// log fields describing where the credentials come from. Unless an explicit
+// CredentialsProvider is configured, the first source with credentials in
+// the following chain is used:
+//
+//  1. the OSS_ACCESS_KEY_ID, OSS_ACCESS_KEY_SECRET and OSS_SESSION_TOKEN
+//     environment variables
+//  2. a profile of the Alibaba Cloud CLI configuration file
+//  3. the AccessKeyID, AccessKeySecret and SecurityToken of config
+func resolveCredentials(config Config, logger *zap.Logger) (credentials.CredentialsProvider, []zap.Field, error) {
+	if config.CredentialsProvider != nil {
+		return config.CredentialsProvider, []zap.Field{zap.String("source", "credentials provider")}, nil
+	}
+
+	if id, secret := os.Getenv(envAccessKeyID), os.Getenv(envAccessKeySecret); id != "" && secret != "" {
+		return credentials.NewStaticCredentialsProvider(id, secret, os.Getenv(envSessionToken)),
+			[]zap.Field{zap.String("source", "environment"), zap.String("access_key_id", maskAccessKeyID(id))}, nil
+	}
+
+	file := config.CredentialsFile
+	if file == "" {
+		file = defaultCredentialsFile()
+	}
+	if file != "" {
+		provider, fields, err := profileCredentials(file, config.Profile)
+		if err != nil {
+			// A broken CLI configuration the user did not point us at should
+			// not prevent falling back to the configured keys.
+			if config.CredentialsFile != "" || config.Profile != "" {
+				return nil, nil, err
+			}
+			logger.Warn("ignoring credentials file", zap.String("file", file), zap.Error(err))
+		}
+		if provider != nil {
+			return provider, append([]zap.Field{zap.String("source", "credentials file"), zap.String("file", file)}, fields...), nil
+		}
+	}
+
+	if config.AccessKeyID != "" && config.AccessKeySecret != "" {
+		return credentials.NewStaticCredentialsProvider(config.AccessKeyID, config.AccessKeySecret, config.SecurityToken),
+			[]zap.Field{zap.String("source", "config"), zap.String("access_key_id", maskAccessKeyID(config.AccessKeyID))}, nil
+	}
+
+	return nil, nil, errors.New("no OSS credentials found in the environment, the credentials file or the config")
+}
+
+// profileCredentials returns the credentials provider for a profile of the
+// Alibaba Cloud CLI configuration file. It returns a nil provider if the
+// file does not exist. An empty profile selects the ALIBABA_CLOUD_PROFILE
+// environment variable, then the current profile of the file.
+func profileCredentials(file, profile string) (credentials.CredentialsProvider, []zap.Field, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading credentials file: %w", err)
+	}
+
+	var cfg cliConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, nil, fmt.Errorf("decoding credentials file %s: %w", file, err)
+	}
+
+	if profile == "" {
+		profile = os.Getenv(envProfile)
+	}
+	if profile == "" {
+		profile = cfg.Current
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	for _, p := range cfg.Profiles {
+		if p.Name != profile {
+			continue
+		}
+		fields := []zap.Field{zap.String("profile", p.Name), zap.String("mode", p.Mode)}
+		switch p.Mode {
+		case "AK", "StsToken":
+			if p.AccessKeyID == "" || p.AccessKeySecret == "" {
+				return nil, nil, fmt.Errorf("profile %s of %s has no access keys", p.Name, file)
+			}
+			fields = append(fields, zap.String("access_key_id", maskAccessKeyID(p.AccessKeyID)))
+			return credentials.NewStaticCredentialsProvider(p.AccessKeyID, p.AccessKeySecret, p.StsToken), fields, nil
+		case "EcsRamRole":
+			fetch := NewECSRoleCredentialsFetcher(ECSRoleConfig{RoleName: p.RAMRoleName})
+			return NewRefreshingCredentialsProvider(fetch, 0), fields, nil
+		case "OIDC":
+			fetch := NewOIDCRoleCredentialsFetcher(OIDCRoleConfig{
+				RoleARN:         p.RAMRoleARN,
+				OIDCProviderARN: p.OIDCProviderARN,
+				TokenFile:       p.OIDCTokenFile,
+				RoleSessionName: p.RoleSessionName,
+			})
+			return NewRefreshingCredentialsProvider(fetch, 0), fields, nil
+		default:
+			return nil, nil, fmt.Errorf("profile %s of %s uses unsupported mode %q", p.Name, file, p.Mode)
+		}
+	}
+	return nil, nil, nil
+}
+
+// maskAccessKeyID hides all but the first and last four characters of an
+// access key ID so that it can be logged.
+func maskAccessKeyID(id string) string {
+	if len(id) <= 8 {
+		return strings.Repeat("*", len(id))
+	}
+	return id[:4] + strings.Repeat("*", len(id)-8) + id[len(id)-4:]
+}
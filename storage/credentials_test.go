@@ -0,0 +1,412 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// countingFetcher returns credentials expiring ttl after now, numbering the
+// access key ID with the fetch count.
+func countingFetcher(now *time.Time, ttl time.Duration, calls *int) CredentialsFetcher {
+	return func(ctx context.Context) (credentials.Credentials, error) {
+		*calls++
+		expires := now.Add(ttl)
+		return credentials.Credentials{
+			AccessKeyID:     fmt.Sprintf("sts-ak-%d", *calls),
+			AccessKeySecret: "sts-sk",
+			SecurityToken:   "sts-token",
+			Expires:         &expires,
+		}, nil
+	}
+}
+
+func TestRefreshingCredentialsProvider_RefreshesBeforeExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	calls := 0
+	p := NewRefreshingCredentialsProvider(countingFetcher(&now, time.Hour, &calls), 5*time.Minute)
+	p.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	creds, err := p.GetCredentials(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "sts-ak-1", creds.AccessKeyID)
+	assert.Equal(t, "sts-token", creds.SecurityToken)
+
+	// Still well within the validity period: cached.
+	now = now.Add(30 * time.Minute)
+	creds, err = p.GetCredentials(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "sts-ak-1", creds.AccessKeyID)
+	assert.Equal(t, 1, calls)
+
+	// Inside the refresh window: refetched.
+	now = now.Add(26 * time.Minute)
+	creds, err = p.GetCredentials(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "sts-ak-2", creds.AccessKeyID)
+	assert.Equal(t, 2, calls)
+}
+
+func TestRefreshingCredentialsProvider_FetchErrors(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	expires := now.Add(time.Hour)
+	fail := false
+	p := NewRefreshingCredentialsProvider(func(ctx context.Context) (credentials.Credentials, error) {
+		if fail {
+			return credentials.Credentials{}, errors.New("sts unavailable")
+		}
+		return credentials.Credentials{AccessKeyID: "ak", AccessKeySecret: "sk", Expires: &expires}, nil
+	}, 5*time.Minute)
+	p.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	_, err := p.GetCredentials(ctx)
+	require.NoError(t, err)
+
+	// A failed refresh keeps serving the still valid credentials.
+	fail = true
+	now = now.Add(58 * time.Minute)
+	creds, err := p.GetCredentials(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "ak", creds.AccessKeyID)
+
+	// Once they have expired, the error is surfaced.
+	now = now.Add(5 * time.Minute)
+	_, err = p.GetCredentials(ctx)
+	assert.ErrorContains(t, err, "sts unavailable")
+}
+
+func TestRefreshingCredentialsProvider_RejectsEmptyKeys(t *testing.T) {
+	p := NewRefreshingCredentialsProvider(func(ctx context.Context) (credentials.Credentials, error) {
+		return credentials.Credentials{}, nil
+	}, 0)
+
+	_, err := p.GetCredentials(context.Background())
+	assert.Error(t, err)
+}
+
+func TestProcessCredentialsFetcher(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "creds.sh")
+	require.NoError(t, os.WriteFile(script, []byte(`#!/bin/sh
+echo '{"AccessKeyId":"STS.ak","AccessKeySecret":"sk","SecurityToken":"token","Expiration":"2030-01-01T00:00:00Z"}'
+`), 0o700))
+
+	creds, err := NewProcessCredentialsFetcher(script)(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "STS.ak", creds.AccessKeyID)
+	assert.Equal(t, "sk", creds.AccessKeySecret)
+	assert.Equal(t, "token", creds.SecurityToken)
+	require.NotNil(t, creds.Expires)
+	assert.Equal(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), creds.Expires.UTC())
+}
+
+func TestProcessCredentialsFetcher_Failure(t *testing.T) {
+	_, err := NewProcessCredentialsFetcher("false")(context.Background())
+	assert.Error(t, err)
+
+	_, err = NewProcessCredentialsFetcher("")(context.Background())
+	assert.Error(t, err)
+}
+
+// mockECSMetadataServer simulates the ECS metadata service in hardened mode,
+// handing out credentials for role that expire ttl after issuance.
+func mockECSMetadataServer(t *testing.T, role string, ttl time.Duration, fetches *int) *httptest.Server {
+	t.Helper()
+	const token = "metadata-token"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Path == "/latest/api/token" {
+			assert.NotEmpty(t, r.Header.Get("X-aliyun-ecs-metadata-token-ttl-seconds"))
+			_, _ = w.Write([]byte(token))
+			return
+		}
+		if r.Header.Get("X-aliyun-ecs-metadata-token") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/ram/security-credentials/":
+			_, _ = w.Write([]byte(role))
+		case "/latest/meta-data/ram/security-credentials/" + role:
+			*fetches++
+			_, _ = fmt.Fprintf(w, `{"Code":"Success","AccessKeyId":"STS.ecs-%d","AccessKeySecret":"sk","SecurityToken":"token","Expiration":%q,"LastUpdated":%q}`,
+				*fetches, time.Now().Add(ttl).UTC().Format(time.RFC3339), time.Now().UTC().Format(time.RFC3339))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestECSRoleCredentialsFetcher_DiscoversRole(t *testing.T) {
+	fetches := 0
+	server := mockECSMetadataServer(t, "certmagic-role", time.Hour, &fetches)
+
+	creds, err := NewECSRoleCredentialsFetcher(ECSRoleConfig{Endpoint: server.URL})(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "STS.ecs-1", creds.AccessKeyID)
+	assert.Equal(t, "token", creds.SecurityToken)
+	require.NotNil(t, creds.Expires)
+}
+
+func TestECSRoleCredentialsFetcher_UnknownRole(t *testing.T) {
+	fetches := 0
+	server := mockECSMetadataServer(t, "certmagic-role", time.Hour, &fetches)
+
+	_, err := NewECSRoleCredentialsFetcher(ECSRoleConfig{Endpoint: server.URL, RoleName: "other-role"})(context.Background())
+	assert.Error(t, err)
+}
+
+func TestECSRoleCredentials_CachedAndRefreshed(t *testing.T) {
+	fetches := 0
+	server := mockECSMetadataServer(t, "certmagic-role", time.Hour, &fetches)
+	p := NewRefreshingCredentialsProvider(NewECSRoleCredentialsFetcher(ECSRoleConfig{
+		Endpoint: server.URL,
+		RoleName: "certmagic-role",
+	}), 5*time.Minute)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		creds, err := p.GetCredentials(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "STS.ecs-1", creds.AccessKeyID)
+	}
+	assert.Equal(t, 1, fetches)
+
+	// Jump close to the expiry: the provider fetches rotated credentials.
+	p.now = func() time.Time { return time.Now().Add(56 * time.Minute) }
+	creds, err := p.GetCredentials(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "STS.ecs-2", creds.AccessKeyID)
+}
+
+// mockSTSServer simulates the AssumeRoleWithOIDC action of STS, accepting
+// only the given OIDC token.
+func mockSTSServer(t *testing.T, wantToken string, calls *int) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "AssumeRoleWithOIDC", r.Form.Get("Action"))
+		assert.Equal(t, "acs:ram::123:role/certmagic", r.Form.Get("RoleArn"))
+		assert.Equal(t, "acs:ram::123:oidc-provider/ack", r.Form.Get("OIDCProviderArn"))
+		assert.Equal(t, "certmagic-oss", r.Form.Get("RoleSessionName"))
+
+		if r.Form.Get("OIDCToken") != wantToken {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"RequestId":"req-1","Code":"InvalidParameter.OIDCToken","Message":"invalid token"}`))
+			return
+		}
+		*calls++
+		_, _ = fmt.Fprintf(w, `{"RequestId":"req-2","Credentials":{"AccessKeyId":"STS.oidc-%d","AccessKeySecret":"sk","SecurityToken":"token","Expiration":%q}}`,
+			*calls, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOIDCRoleCredentialsFetcher(t *testing.T) {
+	calls := 0
+	server := mockSTSServer(t, "rotated-token", &calls)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("initial-token\n"), 0o600))
+
+	fetch := NewOIDCRoleCredentialsFetcher(OIDCRoleConfig{
+		RoleARN:         "acs:ram::123:role/certmagic",
+		OIDCProviderARN: "acs:ram::123:oidc-provider/ack",
+		TokenFile:       tokenFile,
+		STSEndpoint:     server.URL,
+	})
+	ctx := context.Background()
+
+	_, err := fetch(ctx)
+	assert.ErrorContains(t, err, "InvalidParameter.OIDCToken")
+
+	// The token file is re-read on every fetch.
+	require.NoError(t, os.WriteFile(tokenFile, []byte("rotated-token\n"), 0o600))
+	creds, err := fetch(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "STS.oidc-1", creds.AccessKeyID)
+	assert.Equal(t, "token", creds.SecurityToken)
+	require.NotNil(t, creds.Expires)
+}
+
+func TestOIDCRoleCredentialsFetcher_Environment(t *testing.T) {
+	calls := 0
+	server := mockSTSServer(t, "env-token", &calls)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("env-token"), 0o600))
+
+	t.Setenv("ALIBABA_CLOUD_ROLE_ARN", "acs:ram::123:role/certmagic")
+	t.Setenv("ALIBABA_CLOUD_OIDC_PROVIDER_ARN", "acs:ram::123:oidc-provider/ack")
+	t.Setenv("ALIBABA_CLOUD_OIDC_TOKEN_FILE", tokenFile)
+
+	creds, err := NewOIDCRoleCredentialsFetcher(OIDCRoleConfig{STSEndpoint: server.URL})(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "STS.oidc-1", creds.AccessKeyID)
+}
+
+func TestOIDCRoleCredentialsFetcher_MissingConfig(t *testing.T) {
+	t.Setenv("ALIBABA_CLOUD_ROLE_ARN", "")
+	t.Setenv("ALIBABA_CLOUD_OIDC_PROVIDER_ARN", "")
+	t.Setenv("ALIBABA_CLOUD_OIDC_TOKEN_FILE", "")
+
+	_, err := NewOIDCRoleCredentialsFetcher(OIDCRoleConfig{})(context.Background())
+	assert.Error(t, err)
+}
+
+// clearCredentialsEnv unsets the environment variables read by the default
+// credential chain.
+func clearCredentialsEnv(t *testing.T) {
+	t.Helper()
+	for _, env := range []string{"OSS_ACCESS_KEY_ID", "OSS_ACCESS_KEY_SECRET", "OSS_SESSION_TOKEN", "ALIBABA_CLOUD_PROFILE"} {
+		t.Setenv(env, "")
+	}
+}
+
+func writeCredentialsFile(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+	return file
+}
+
+const testCredentialsFile = `{
+	"current": "default",
+	"profiles": [
+		{"name": "default", "mode": "AK", "access_key_id": "LTAIdefault0001", "access_key_secret": "default-secret"},
+		{"name": "sts", "mode": "StsToken", "access_key_id": "STS.profile0001", "access_key_secret": "sts-secret", "sts_token": "profile-token"},
+		{"name": "legacy", "mode": "RsaKeyPair"}
+	]
+}`
+
+func TestResolveCredentials_Chain(t *testing.T) {
+	ctx := context.Background()
+	file := writeCredentialsFile(t, testCredentialsFile)
+	missing := filepath.Join(t.TempDir(), "missing.json")
+	explicit := Config{AccessKeyID: "LTAIexplicit0001", AccessKeySecret: "explicit-secret"}
+
+	tests := []struct {
+		name       string
+		env        map[string]string
+		file       string
+		profile    string
+		wantSource string
+		wantID     string
+		wantToken  string
+	}{
+		{
+			name:       "environment",
+			env:        map[string]string{"OSS_ACCESS_KEY_ID": "LTAIenv00000001", "OSS_ACCESS_KEY_SECRET": "env-secret", "OSS_SESSION_TOKEN": "env-token"},
+			file:       file,
+			wantSource: "environment",
+			wantID:     "LTAIenv00000001",
+			wantToken:  "env-token",
+		},
+		{
+			name:       "current profile",
+			file:       file,
+			wantSource: "credentials file",
+			wantID:     "LTAIdefault0001",
+		},
+		{
+			name:       "selected profile",
+			file:       file,
+			profile:    "sts",
+			wantSource: "credentials file",
+			wantID:     "STS.profile0001",
+			wantToken:  "profile-token",
+		},
+		{
+			name:       "profile from environment",
+			env:        map[string]string{"ALIBABA_CLOUD_PROFILE": "sts"},
+			file:       file,
+			wantSource: "credentials file",
+			wantID:     "STS.profile0001",
+			wantToken:  "profile-token",
+		},
+		{
+			name:       "explicit config",
+			file:       missing,
+			wantSource: "config",
+			wantID:     "LTAIexplicit0001",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearCredentialsEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			config := explicit
+			config.CredentialsFile = tt.file
+			config.Profile = tt.profile
+
+			provider, fields, err := resolveCredentials(config, zap.NewNop())
+			require.NoError(t, err)
+			assert.Contains(t, fields, zap.String("source", tt.wantSource))
+
+			creds, err := provider.GetCredentials(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantID, creds.AccessKeyID)
+			assert.Equal(t, tt.wantToken, creds.SecurityToken)
+		})
+	}
+}
+
+func TestResolveCredentials_Errors(t *testing.T) {
+	clearCredentialsEnv(t)
+	file := writeCredentialsFile(t, testCredentialsFile)
+
+	// Nothing configured at all.
+	_, _, err := resolveCredentials(Config{CredentialsFile: filepath.Join(t.TempDir(), "missing.json")}, zap.NewNop())
+	assert.Error(t, err)
+
+	// An explicitly selected profile with an unsupported mode.
+	_, _, err = resolveCredentials(Config{CredentialsFile: file, Profile: "legacy"}, zap.NewNop())
+	assert.ErrorContains(t, err, "unsupported mode")
+}
+
+func TestResolveCredentials_DoesNotLogSecrets(t *testing.T) {
+	clearCredentialsEnv(t)
+	t.Setenv("HOME", t.TempDir())
+	core, logs := observer.New(zap.InfoLevel)
+
+	_, err := NewStorage(context.Background(), Config{
+		BucketName:      testBucket,
+		Region:          "test-region",
+		AccessKeyID:     "LTAI5tAbCdEfGhIj",
+		AccessKeySecret: "super-secret-value",
+		Logger:          zap.New(core),
+	})
+	require.NoError(t, err)
+
+	entries := logs.FilterMessage("using OSS credentials").All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "config", fields["source"])
+	assert.Equal(t, "LTAI********GhIj", fields["access_key_id"])
+	for _, v := range fields {
+		assert.NotContains(t, fmt.Sprint(v), "super-secret-value")
+	}
+}
+
+func TestMaskAccessKeyID(t *testing.T) {
+	assert.Equal(t, "LTAI****mnop", maskAccessKeyID("LTAIabcdmnop"))
+	assert.Equal(t, "******", maskAccessKeyID("short1"))
+	assert.Equal(t, "", maskAccessKeyID(""))
+}
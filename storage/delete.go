@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+)
+
+const (
+	// deleteBatchSize is the maximum number of objects deleted by a
+	// DeleteMultipleObjects request.
+	deleteBatchSize = 1000
+	// deleteConcurrency is the maximum number of DeleteMultipleObjects
+	// requests in flight while deleting a "directory".
+	deleteConcurrency = 4
+)
+
+// deletePrefix deletes the objects whose key starts with prefix, except lock
+// objects, which belong to their holders and the reaper. The objects are
+// deleted in batches of deleteBatchSize, deleteConcurrency batches at a
+// time. Failures do not stop the deletion of the other batches, and are
+// returned together. If the listing fails, the objects listed so far are
+// still deleted, and the error reports that others may remain.
+func (s *Storage) deletePrefix(ctx context.Context, prefix string) error {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		errs    []error
+		failed  int
+		total   int
+		listErr error
+	)
+	sem := make(chan struct{}, deleteConcurrency)
+	deleteBatch := func(keys []string) {
+		defer wg.Done()
+		defer func() { <-sem }()
+		n, err := s.deleteObjects(ctx, keys)
+		if err != nil {
+			mu.Lock()
+			errs = append(errs, err)
+			failed += n
+			mu.Unlock()
+		}
+	}
+
+	p := s.client.NewListObjectsV2Paginator(&oss.ListObjectsV2Request{
+		Bucket: oss.Ptr(s.bucketName),
+		Prefix: oss.Ptr(s.objName(prefix)),
+	}, func(o *oss.PaginatorOptions) {
+		o.Limit = deleteBatchSize
+	})
+	var batch []string
+	for p.HasNext() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			listErr = err
+			break
+		}
+		for _, object := range page.Contents {
+			if isLockObject(*object.Key) {
+				continue
+			}
+			batch = append(batch, *object.Key)
+			total++
+			if len(batch) == deleteBatchSize {
+				sem <- struct{}{}
+				wg.Add(1)
+				go deleteBatch(batch)
+				batch = nil
+			}
+		}
+	}
+	if len(batch) > 0 {
+		sem <- struct{}{}
+		wg.Add(1)
+		go deleteBatch(batch)
+	}
+	wg.Wait()
+
+	if listErr != nil {
+		return fmt.Errorf("deleting %s: listing incomplete, unlisted objects not deleted, %d of %d listed objects not deleted: %w",
+			prefix, failed, total, errors.Join(append([]error{listErr}, errs...)...))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("deleting %s: %d of %d objects not deleted: %w", prefix, failed, total, errors.Join(errs...))
+	}
+	return nil
+}
+
+// deleteObjects deletes keys with a DeleteMultipleObjects request. It
+// returns the number of keys which may not have been deleted along with the
+// error.
+func (s *Storage) deleteObjects(ctx context.Context, keys []string) (int, error) {
+	objects := make([]oss.DeleteObject, len(keys))
+	for i, key := range keys {
+		objects[i] = oss.DeleteObject{Key: oss.Ptr(key)}
+	}
+	result, err := s.client.DeleteMultipleObjects(ctx, &oss.DeleteMultipleObjectsRequest{
+		Bucket:  oss.Ptr(s.bucketName),
+		Objects: objects,
+	})
+	if err != nil {
+		return len(keys), fmt.Errorf("deleting %s to %s: %w", keys[0], keys[len(keys)-1], err)
+	}
+
+	// OSS lists the objects deleted, whether they existed or not
+	deleted := make(map[string]bool, len(result.DeletedObjects))
+	for _, object := range result.DeletedObjects {
+		deleted[oss.ToString(object.Key)] = true
+	}
+	var missing []string
+	for _, key := range keys {
+		if !deleted[key] {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return len(missing), fmt.Errorf("%d objects not deleted, including %s", len(missing), missing[0])
+	}
+	return 0, nil
+}
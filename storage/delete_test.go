@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// isDeleteMultipleObjects reports whether r is a DeleteMultipleObjects
+// request.
+func isDeleteMultipleObjects(r *http.Request) bool {
+	_, ok := r.URL.Query()["delete"]
+	return r.Method == http.MethodPost && ok
+}
+
+// storeObjects stores n objects beneath dir.
+func storeObjects(t *testing.T, s *Storage, dir string, n int) {
+	t.Helper()
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		require.NoError(t, s.Store(ctx, fmt.Sprintf("%s/%04d/cert.pem", dir, i), []byte("data")))
+	}
+}
+
+func TestDelete_Directory(t *testing.T) {
+	var requests, inFlight, maxInFlight atomic.Int32
+	mock := mockOSSHandler(time.Now)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isDeleteMultipleObjects(r) {
+			requests.Add(1)
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				max := maxInFlight.Load()
+				if n <= max || maxInFlight.CompareAndSwap(max, n) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	s := connectTestStorage(t, server, "test-instance")
+	ctx := context.Background()
+
+	dir := "certificates/acme"
+	storeObjects(t, s, dir, 3*deleteBatchSize+1)
+	require.NoError(t, s.Store(ctx, dir, []byte("object named like the directory")))
+	require.NoError(t, s.Store(ctx, "certificates/acme.json", []byte("sibling")))
+	require.NoError(t, s.Store(ctx, "certificates/acme2/cert.pem", []byte("sibling")))
+	require.NoError(t, s.Lock(ctx, dir+"/0001/cert.pem"))
+
+	require.NoError(t, s.Delete(ctx, dir))
+
+	assert.Equal(t, int32(4), requests.Load(), "batches of %d objects", deleteBatchSize)
+	assert.Greater(t, maxInFlight.Load(), int32(1), "batches deleted concurrently")
+	assert.LessOrEqual(t, maxInFlight.Load(), int32(deleteConcurrency))
+
+	remaining, err := s.List(ctx, "certificates", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"certificates/acme.json",
+		dir + "/0001/cert.pem.lock",
+		"certificates/acme2/cert.pem",
+	}, remaining, "lock objects and siblings are kept")
+	require.NoError(t, s.Unlock(ctx, dir+"/0001/cert.pem"))
+}
+
+func TestDelete_TrailingSlash(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+	require.NoError(t, s.Store(ctx, "ocsp", []byte("object")))
+	require.NoError(t, s.Store(ctx, "ocsp/example.com", []byte("staple")))
+
+	require.NoError(t, s.Delete(ctx, "ocsp/"))
+	assert.False(t, s.Exists(ctx, "ocsp/example.com"))
+	assert.True(t, s.Exists(ctx, "ocsp"), "only deleted as a directory")
+}
+
+func TestDelete_PartialFailure(t *testing.T) {
+	mock := mockOSSHandler(time.Now)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isDeleteMultipleObjects(r) {
+			body, _ := io.ReadAll(r.Body)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			switch {
+			case bytes.Contains(body, []byte("certificates/acme/0000/")):
+				w.WriteHeader(http.StatusForbidden)
+				writeOSSError(w, "AccessDenied", "You have no right to access this object.")
+				return
+			case bytes.Contains(body, []byte("certificates/acme/2000/")):
+				// Nothing deleted
+				w.Header().Set("Content-Type", "application/xml")
+				_, _ = io.WriteString(w, "<DeleteResult></DeleteResult>")
+				return
+			}
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	s := connectTestStorage(t, server, "test-instance")
+	ctx := context.Background()
+	storeObjects(t, s, "certificates/acme", 2*deleteBatchSize+10)
+
+	err := s.Delete(ctx, "certificates/acme")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("%d of %d objects not deleted", deleteBatchSize+10, 2*deleteBatchSize+10))
+	assert.Contains(t, err.Error(), "AccessDenied")
+	assert.Contains(t, err.Error(), "10 objects not deleted, including certificates/acme/2000/cert.pem")
+
+	assert.True(t, s.Exists(ctx, "certificates/acme/0000/cert.pem"))
+	assert.False(t, s.Exists(ctx, "certificates/acme/1000/cert.pem"), "other batches are deleted")
+	assert.True(t, s.Exists(ctx, "certificates/acme/2000/cert.pem"))
+}
+
+func TestDelete_ListingFails(t *testing.T) {
+	mock := mockOSSHandler(time.Now)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("continuation-token") != "" {
+			w.WriteHeader(http.StatusForbidden)
+			writeOSSError(w, "AccessDenied", "You have no right to access this bucket.")
+			return
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	s := connectTestStorage(t, server, "test-instance")
+	ctx := context.Background()
+	storeObjects(t, s, "certificates/acme", deleteBatchSize+10)
+
+	err := s.Delete(ctx, "certificates/acme")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "listing incomplete")
+	assert.Contains(t, err.Error(), fmt.Sprintf("0 of %d listed objects not deleted", deleteBatchSize))
+	assert.Contains(t, err.Error(), "AccessDenied")
+
+	assert.False(t, s.Exists(ctx, "certificates/acme/0000/cert.pem"), "listed objects are deleted")
+	assert.True(t, s.Exists(ctx, "certificates/acme/1000/cert.pem"))
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/google/tink/go/aead/subtle"
+	"github.com/google/tink/go/subtle/random"
+	"github.com/google/tink/go/tink"
+)
+
+// KEK is a key encryption key, used by envelope encryption to wrap and
+// unwrap the data key of each object. Any tink.AEAD can act as a KEK, in
+// particular the remote AEAD of a KMS client.
+type KEK = tink.AEAD
+
+// Envelope encrypted objects start with envelopeMagic followed by a format
+// version. Version 1 continues with the big-endian uint16 length of the
+// wrapped data key, the wrapped data key and the AES-256-GCM ciphertext of
+// the payload:
+//
+//	"CMOE" | 0x01 | len(wrapped DEK) | wrapped DEK | ciphertext
+var envelopeMagic = []byte("CMOE")
+
+const (
+	envelopeVersion1   byte = 1
+	envelopeDEKSize         = 32
+	envelopeHeaderSize      = 4 + 1 + 2 // magic, version, wrapped DEK length
+)
+
+// errNotEnvelope is returned when decrypting data without an envelope header.
+var errNotEnvelope = errors.New("missing envelope encryption header")
+
+// envelopeAEAD implements tink.AEAD with envelope encryption: every Encrypt
+// generates a fresh data encryption key (DEK), encrypts the plaintext with
+// it and stores the DEK wrapped by the KEK in front of the ciphertext. The
+// KEK therefore only ever encrypts 32 bytes per object, and rotating it only
+// requires rewrapping data keys.
+type envelopeAEAD struct {
+	kek KEK
+}
+
+// Interface guards
+var (
+	_ tink.AEAD = (*envelopeAEAD)(nil)
+)
+
+// Encrypt encrypts plaintext under a new data key. associatedData (the
+// object key) is authenticated both with the payload and the wrapped DEK.
+func (e *envelopeAEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	dek := random.GetRandomBytes(envelopeDEKSize)
+	cipher, err := subtle.NewAESGCM(dek)
+	if err != nil {
+		return nil, fmt.Errorf("creating data key cipher: %w", err)
+	}
+	wrapped, err := e.kek.Encrypt(dek, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("wrapping data key: %w", err)
+	}
+	if len(wrapped) > 0xffff {
+		return nil, fmt.Errorf("wrapped data key too large: %d bytes", len(wrapped))
+	}
+	ciphertext, err := cipher.Encrypt(plaintext, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting with data key: %w", err)
+	}
+
+	out := make([]byte, 0, envelopeHeaderSize+len(wrapped)+len(ciphertext))
+	out = append(out, envelopeMagic...)
+	out = append(out, envelopeVersion1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(wrapped)))
+	out = append(out, wrapped...)
+	return append(out, ciphertext...), nil
+}
+
+// Decrypt unwraps the data key of ciphertext with the KEK and decrypts the
+// payload with it.
+func (e *envelopeAEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	if !isEnvelope(ciphertext) {
+		return nil, errNotEnvelope
+	}
+	if version := ciphertext[len(envelopeMagic)]; version != envelopeVersion1 {
+		return nil, fmt.Errorf("unsupported envelope version %d", version)
+	}
+	if len(ciphertext) < envelopeHeaderSize {
+		return nil, errors.New("truncated envelope header")
+	}
+	wrappedLen := int(binary.BigEndian.Uint16(ciphertext[len(envelopeMagic)+1:]))
+	if len(ciphertext) < envelopeHeaderSize+wrappedLen {
+		return nil, errors.New("truncated wrapped data key")
+	}
+	wrapped := ciphertext[envelopeHeaderSize : envelopeHeaderSize+wrappedLen]
+
+	dek, err := e.kek.Decrypt(wrapped, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key: %w", err)
+	}
+	cipher, err := subtle.NewAESGCM(dek)
+	if err != nil {
+		return nil, fmt.Errorf("creating data key cipher: %w", err)
+	}
+	return cipher.Decrypt(ciphertext[envelopeHeaderSize+wrappedLen:], associatedData)
+}
+
+// isEnvelope reports whether data starts with an envelope encryption header.
+func isEnvelope(data []byte) bool {
+	return len(data) > len(envelopeMagic) && bytes.HasPrefix(data, envelopeMagic)
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingKEK records how many bytes the wrapped KEK encrypted.
+type countingKEK struct {
+	tink.AEAD
+	encrypted [][]byte
+}
+
+func (k *countingKEK) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	k.encrypted = append(k.encrypted, plaintext)
+	return k.AEAD.Encrypt(plaintext, associatedData)
+}
+
+func newTestKEK(t *testing.T) (*keyset.Manager, *countingKEK) {
+	t.Helper()
+	manager := keyset.NewManager()
+	keyID, err := manager.Add(aead.AES256GCMKeyTemplate())
+	require.NoError(t, err)
+	require.NoError(t, manager.SetPrimary(keyID))
+	kh, err := manager.Handle()
+	require.NoError(t, err)
+	kp, err := aead.New(kh)
+	require.NoError(t, err)
+	return manager, &countingKEK{AEAD: kp}
+}
+
+func TestEnvelopeEncryption_StoreLoad(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	_, kek := newTestKEK(t)
+	s.aead = &envelopeAEAD{kek: kek}
+	ctx := context.Background()
+
+	content := bytes.Repeat([]byte("certificate data "), 100)
+	require.NoError(t, s.Store(ctx, "certs/a.pem", content))
+	require.NoError(t, s.Store(ctx, "certs/b.pem", content))
+
+	// The KEK only ever sees one 32 bytes data key per object.
+	require.Len(t, kek.encrypted, 2)
+	for _, dek := range kek.encrypted {
+		assert.Len(t, dek, envelopeDEKSize)
+	}
+	assert.NotEqual(t, kek.encrypted[0], kek.encrypted[1], "each object must get its own data key")
+
+	loaded, err := s.Load(ctx, "certs/a.pem")
+	require.NoError(t, err)
+	assert.Equal(t, content, loaded)
+
+	// The stored object carries the versioned header.
+	raw, metadata := loadRaw(t, s, "certs/b.pem")
+	assert.Equal(t, encryptionEnvelope, metadata[metaEncryption])
+	assert.True(t, isEnvelope(raw))
+	assert.Equal(t, envelopeVersion1, raw[len(envelopeMagic)])
+	assert.NotContains(t, string(raw), "certificate data")
+}
+
+func TestEnvelopeEncryption_KEKRotation(t *testing.T) {
+	manager, kek := newTestKEK(t)
+	e := &envelopeAEAD{kek: kek}
+	old, err := e.Encrypt([]byte("secret"), []byte("key"))
+	require.NoError(t, err)
+
+	// Rotate the KEK: objects wrapped under the old key stay readable while
+	// new objects are wrapped under the new primary key.
+	keyID, err := manager.Add(aead.AES256GCMKeyTemplate())
+	require.NoError(t, err)
+	require.NoError(t, manager.SetPrimary(keyID))
+	kh, err := manager.Handle()
+	require.NoError(t, err)
+	rotated, err := aead.New(kh)
+	require.NoError(t, err)
+	e = &envelopeAEAD{kek: rotated}
+
+	decrypted, err := e.Decrypt(old, []byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), decrypted)
+}
+
+func TestEnvelopeEncryption_Rejects(t *testing.T) {
+	_, kek := newTestKEK(t)
+	e := &envelopeAEAD{kek: kek}
+	ciphertext, err := e.Encrypt([]byte("secret"), []byte("key"))
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		data []byte
+		ad   string
+	}{
+		"other object key":  {ciphertext, "other-key"},
+		"no header":         {[]byte("plaintext"), "key"},
+		"unknown version":   {append(append([]byte("CMOE"), 9), ciphertext[5:]...), "key"},
+		"truncated header":  {ciphertext[:6], "key"},
+		"truncated DEK":     {ciphertext[:envelopeHeaderSize+4], "key"},
+		"tampered payload":  {append(append([]byte{}, ciphertext[:len(ciphertext)-1]...), ciphertext[len(ciphertext)-1]^1), "key"},
+		"tampered wrapping": {append(append(append([]byte{}, ciphertext[:envelopeHeaderSize]...), ciphertext[envelopeHeaderSize]^1), ciphertext[envelopeHeaderSize+1:]...), "key"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := e.Decrypt(tt.data, []byte(tt.ad))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNewStorage_AEADAndKEKExclusive(t *testing.T) {
+	_, kek := newTestKEK(t)
+	_, err := NewStorage(context.Background(), Config{
+		AccessKeyID:     "test-ak",
+		AccessKeySecret: "test-sk",
+		AEAD:            kek,
+		KEK:             kek,
+	})
+	assert.Error(t, err)
+}
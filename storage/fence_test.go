@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// objectFence returns the fencing token recorded in the metadata of key.
+func objectFence(t *testing.T, s *Storage, key string) string {
+	t.Helper()
+	result, err := s.client.HeadObject(context.Background(), &oss.HeadObjectRequest{
+		Bucket: oss.Ptr(s.bucketName),
+		Key:    oss.Ptr(key),
+	})
+	require.NoError(t, err)
+	return result.Metadata[metaFence]
+}
+
+func TestLockContext_FencingToken(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+
+	_, held := s.FencingToken("example.com")
+	assert.False(t, held)
+
+	holderCtx, err := s.LockContext(ctx, "example.com")
+	require.NoError(t, err)
+	state, err := s.readLock(ctx, s.objLockName("example.com"))
+	require.NoError(t, err)
+	require.NotZero(t, state.record.Fence)
+
+	fence, held := s.FencingToken("example.com")
+	assert.True(t, held)
+	assert.Equal(t, state.record.Fence, fence)
+	fromCtx, ok := FencingTokenFromContext(holderCtx)
+	assert.True(t, ok)
+	assert.Equal(t, fence, fromCtx)
+
+	// The fencing token is recorded by the writes made under the lock.
+	require.NoError(t, s.Store(holderCtx, "certs/example.com.crt", []byte("cert")))
+	assert.Equal(t, strconv.FormatUint(fence, 10), objectFence(t, s, "certs/example.com.crt"))
+
+	require.NoError(t, s.Unlock(ctx, "example.com"))
+	_, held = s.FencingToken("example.com")
+	assert.False(t, held)
+
+	// The next acquisition has a newer fencing token.
+	require.NoError(t, s.Lock(ctx, "example.com"))
+	next, _ := s.FencingToken("example.com")
+	assert.Greater(t, next, fence)
+	require.NoError(t, s.Unlock(ctx, "example.com"))
+}
+
+func TestLock_FencingTokenIncreasesOnTakeover(t *testing.T) {
+	local := newFakeClock()
+	a, b := setupSkewedStorages(t, local, 0)
+	ctx := context.Background()
+
+	// A fencing token ahead of the clock, e.g. after many takeovers within
+	// a millisecond: the next one must still be newer.
+	record, err := a.newLockRecord()
+	require.NoError(t, err)
+	record.ExpiresAt = record.AcquiredAt
+	record.Fence += 1000
+	require.NoError(t, a.writeLock(ctx, a.objLockName("example.com"), record, true))
+
+	require.NoError(t, b.Lock(ctx, "example.com"))
+	fence, held := b.FencingToken("example.com")
+	require.True(t, held)
+	assert.Equal(t, record.Fence+1, fence)
+}
+
+func TestLock_FencingTokenIncreasesAcrossInstances(t *testing.T) {
+	local := newFakeClock()
+	a, b := setupSkewedStorages(t, local, 0)
+	a.lockPrefix = "locks/"
+	b.lockPrefix = "locks/"
+	ctx := context.Background()
+
+	// b's clock stops once b synced with the server, so that b estimates
+	// the time of the server 10 minutes behind a.
+	bLocal := newFakeClock()
+	b.clock.local = bLocal.Now
+	b.syncClock(ctx, b.objLockName("example.com"))
+	local.Add(10 * time.Minute)
+
+	var last uint64
+	for i, s := range []*Storage{a, b, a, b} {
+		require.NoError(t, s.Lock(ctx, "example.com"), i)
+		fence, _ := s.FencingToken("example.com")
+		assert.Greater(t, fence, last, i)
+		last = fence
+		require.NoError(t, s.Unlock(ctx, "example.com"), i)
+
+		// The released lock object carries the fencing token over.
+		state, err := s.readLock(ctx, s.objLockName("example.com"))
+		require.NoError(t, err)
+		assert.True(t, state.record.Released)
+		assert.Equal(t, fence, state.record.Fence)
+	}
+}
+
+func TestStore_RejectStaleWrites(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	s.rejectStaleWrites = true
+	ctx := context.Background()
+	key := "certs/example.com.crt"
+
+	require.NoError(t, s.Store(WithFencingToken(ctx, 2), key, []byte("new holder")))
+	err := s.Store(WithFencingToken(ctx, 1), key, []byte("stale holder"))
+	assert.ErrorIs(t, err, ErrStaleFencingToken)
+	value, err := s.Load(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, "new holder", string(value))
+
+	// The holder of the current token may write again, as may a newer one.
+	require.NoError(t, s.Store(WithFencingToken(ctx, 2), key, []byte("again")))
+	require.NoError(t, s.Store(WithFencingToken(ctx, 3), key, []byte("newer holder")))
+	assert.Equal(t, "3", objectFence(t, s, key))
+
+	// Writes made outside of a lock are not checked.
+	require.NoError(t, s.Store(ctx, key, []byte("unlocked")))
+	assert.Empty(t, objectFence(t, s, key))
+}
+
+func TestStore_StaleWritesAllowedByDefault(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+	key := "certs/example.com.crt"
+
+	require.NoError(t, s.Store(WithFencingToken(ctx, 2), key, []byte("new holder")))
+	require.NoError(t, s.Store(WithFencingToken(ctx, 1), key, []byte("stale holder")))
+	assert.Equal(t, "1", objectFence(t, s, key))
+}
@@ -0,0 +1,420 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"go.uber.org/zap"
+)
+
+// ErrLockNotHeld is returned by Unlock when the lock object belongs to
+// another holder, e.g. because our lock expired and was taken over.
+var ErrLockNotHeld = errors.New("lock is not held by this storage")
+
+// ErrLockLost is the cause of the cancellation of the context returned by
+// LockContext when the lease of the lock could not be renewed.
+var ErrLockLost = errors.New("lock lost")
+
+// lockRecord is the content of a lock object. It identifies the holder of
+// the lock so that only the holder releases it.
+type lockRecord struct {
+	// Owner is the instance ID of the holder.
+	Owner string `json:"owner"`
+	// Token is a random value identifying this acquisition of the lock.
+	Token      string    `json:"token"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Fence is the fencing token of this acquisition of the lock.
+	Fence uint64 `json:"fence,omitempty"`
+	// Released is set once the lock was released. The lock object is kept,
+	// so that the next acquisition carries on from its Fence.
+	Released bool `json:"released,omitempty"`
+}
+
+// String describes the holder of the lock for error messages.
+func (r lockRecord) String() string {
+	if r.Released {
+		return "nobody, released"
+	}
+	if r.Owner == "" {
+		return "unknown owner"
+	}
+	return fmt.Sprintf("%s since %s, expiring %s", r.Owner,
+		r.AcquiredAt.Format(time.RFC3339), r.ExpiresAt.Format(time.RFC3339))
+}
+
+// defaultInstanceID identifies this process in lock records.
+func defaultInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
+
+// newLockToken returns a random token identifying an acquisition of a lock.
+func newLockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating lock token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newLockRecord returns the record of a new acquisition of a lock by s.
+// Its times are in the time of the OSS server.
+func (s *Storage) newLockRecord() (lockRecord, error) {
+	token, err := newLockToken()
+	if err != nil {
+		return lockRecord{}, err
+	}
+	now := s.clock.now()
+	return lockRecord{
+		Owner:      s.instanceID,
+		Token:      token,
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(s.lockExpiration),
+		Fence:      s.nextFence(0),
+	}, nil
+}
+
+// lockState is a lock object as read from OSS.
+type lockState struct {
+	record       lockRecord
+	etag         string
+	lastModified time.Time
+	// serverTime is the time of the server when the lock was read.
+	serverTime time.Time
+}
+
+// expiresAt returns when the lock expires. Lock objects written by older
+// versions carry no expiry and expire lockExpiration after they were
+// written.
+func (l lockState) expiresAt(lockExpiration time.Duration) time.Time {
+	if !l.record.ExpiresAt.IsZero() {
+		return l.record.ExpiresAt
+	}
+	return l.lastModified.Add(lockExpiration)
+}
+
+// expired reports whether the lock had expired when it was read, according
+// to the clock of the server.
+func (l lockState) expired(lockExpiration time.Duration) bool {
+	return l.record.Released || !l.serverTime.Before(l.expiresAt(lockExpiration))
+}
+
+// readLock reads the lock object lockKey, or returns fs.ErrNotExist. Lock
+// objects written by older versions are empty and yield a zero record.
+func (s *Storage) readLock(ctx context.Context, lockKey string) (lockState, error) {
+	var state lockState
+	result, err := s.client.GetObject(ctx, &oss.GetObjectRequest{
+		Bucket: oss.Ptr(s.bucketName),
+		Key:    oss.Ptr(s.objName(lockKey)),
+	})
+	if err != nil {
+		s.clock.observeErr(err)
+		if isNotFound(err) {
+			return state, fs.ErrNotExist
+		}
+		return state, fmt.Errorf("reading lock %s: %w", lockKey, err)
+	}
+	defer result.Body.Close()
+
+	state.serverTime = s.clock.observe(result.Headers)
+	if state.serverTime.IsZero() {
+		state.serverTime = s.clock.now()
+	}
+	state.etag = oss.ToString(result.ETag)
+	if result.LastModified != nil {
+		state.lastModified = *result.LastModified
+	}
+
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return state, fmt.Errorf("reading lock %s: %w", lockKey, err)
+	}
+	if len(data) == 0 {
+		return state, nil
+	}
+	if err := json.Unmarshal(data, &state.record); err != nil {
+		return state, fmt.Errorf("decoding lock %s: %w", lockKey, err)
+	}
+	return state, nil
+}
+
+// syncClock observes the server time, if it was not yet, so that lock
+// records can be written in server time.
+func (s *Storage) syncClock(ctx context.Context, lockKey string) {
+	if s.clock.isSynced() {
+		return
+	}
+	result, err := s.client.HeadObject(ctx, &oss.HeadObjectRequest{
+		Bucket: oss.Ptr(s.bucketName),
+		Key:    oss.Ptr(s.objName(lockKey)),
+	})
+	if err != nil {
+		s.clock.observeErr(err)
+		return
+	}
+	s.clock.observe(result.Headers)
+}
+
+// writeLock writes record to the lock object lockKey. With create, the write
+// fails if the object already exists.
+func (s *Storage) writeLock(ctx context.Context, lockKey string, record lockRecord, create bool) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("encoding lock %s: %w", lockKey, err)
+	}
+	req := &oss.PutObjectRequest{
+		Bucket: oss.Ptr(s.bucketName),
+		Key:    oss.Ptr(s.objName(lockKey)),
+		Body:   bytes.NewReader(body),
+	}
+	if create {
+		// This ensures the object is only created if it doesn't exist
+		req.ForbidOverwrite = oss.Ptr("true")
+	}
+	result, err := s.client.PutObject(ctx, s.withSSE(req))
+	if err != nil {
+		s.clock.observeErr(err)
+		return err
+	}
+	s.clock.observe(result.Headers)
+	return nil
+}
+
+// keepsLockObject reports whether the lock object lockKey of the lock on
+// key is kept once released, to carry the fencing token of the lock over to
+// its next acquisition, until the reaper deletes it. Only the lock objects
+// under LockPrefix are kept: those next to their key are deleted, as older
+// versions cannot read released records and would wait for them to expire.
+func (s *Storage) keepsLockObject(key, lockKey string) bool {
+	return s.lockPrefix != "" && lockKey == s.objLockName(key)
+}
+
+// releaseLockObject releases the lock object lockKey of the lock on key,
+// which recorded prev: it is replaced by a released record carrying the
+// fencing token of prev, or deleted (see keepsLockObject). It must be
+// applied through transitionLock.
+func (s *Storage) releaseLockObject(ctx context.Context, key, lockKey string, prev lockRecord) error {
+	if !s.keepsLockObject(key, lockKey) {
+		return s.deleteLock(ctx, lockKey)
+	}
+	return s.writeLock(ctx, lockKey, lockRecord{
+		Owner:    prev.Owner,
+		Fence:    prev.Fence,
+		Released: true,
+	}, false)
+}
+
+// deleteLock deletes the lock object lockKey.
+func (s *Storage) deleteLock(ctx context.Context, lockKey string) error {
+	_, err := s.client.DeleteObject(ctx, &oss.DeleteObjectRequest{
+		Bucket: oss.Ptr(s.bucketName),
+		Key:    oss.Ptr(s.objName(lockKey)),
+	})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("deleting lock %s: %w", lockKey, err)
+	}
+	return nil
+}
+
+// lockLease tracks a lock held by s and the renewal of its lease.
+type lockLease struct {
+	key   string
+	token string
+	fence uint64
+	// expiresAt is the expiry of the lease, guarded by Storage.locksMu.
+	expiresAt time.Time
+	// cancel cancels the context returned by LockContext.
+	cancel context.CancelCauseFunc
+	// stop is closed by Unlock to stop the renewal, done is closed once the
+	// renewal stopped.
+	stop chan struct{}
+	done chan struct{}
+}
+
+// heldLock returns the lease of the lock held by s on key, if any.
+func (s *Storage) heldLock(key string) (*lockLease, bool) {
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+	lease, ok := s.locks[key]
+	return lease, ok
+}
+
+// setHeldLock records that s holds the lock on key with lease.
+func (s *Storage) setHeldLock(key string, lease *lockLease) {
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+	if s.locks == nil {
+		s.locks = make(map[string]*lockLease)
+	}
+	s.locks[key] = lease
+}
+
+// renewInterval returns the interval between renewals of the lock leases,
+// or 0 if they are not renewed.
+func (s *Storage) renewInterval() time.Duration {
+	switch {
+	case s.lockRenewInterval < 0:
+		return 0
+	case s.lockRenewInterval == 0:
+		return s.lockExpiration / 3
+	default:
+		return s.lockRenewInterval
+	}
+}
+
+// startLease records that s acquired the lock on key with record and starts
+// renewing its lease in the background. It returns the context of the
+// holder, cancelled if the lock is lost, which carries the fencing token of
+// the lock and identifies the lease in Unlock.
+func (s *Storage) startLease(key string, record lockRecord) context.Context {
+	lease := &lockLease{
+		key:       key,
+		token:     record.Token,
+		fence:     record.Fence,
+		expiresAt: record.ExpiresAt,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	ctx := context.WithValue(WithFencingToken(context.Background(), record.Fence), leaseKey{}, lease)
+	ctx, lease.cancel = context.WithCancelCause(ctx)
+	s.setHeldLock(key, lease)
+
+	if interval := s.renewInterval(); interval > 0 {
+		go s.renewLease(key, lease, record.ExpiresAt, interval)
+	} else {
+		close(lease.done)
+	}
+	return ctx
+}
+
+type leaseKey struct{}
+
+// supersedeLease forgets the expired lease of the lock held by s on key,
+// when another goroutine of s takes the place of its holder in the queue of
+// key. s.locksMu must be held; the returned lease must be ended once it is
+// released.
+func (s *Storage) supersedeLease(key string) *lockLease {
+	lease := s.locks[key]
+	delete(s.locks, key)
+	return lease
+}
+
+// releaseLease forgets the lease of the lock held by s on key, which
+// Unlock(ctx, key) releases, if any. If ctx is, or derives from, the holder
+// context of an earlier lease of the lock on key, which was superseded or
+// released already, that lease is returned instead and superseded is true.
+func (s *Storage) releaseLease(ctx context.Context, key string) (lease *lockLease, superseded bool) {
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+	current := s.locks[key]
+	if held, ok := ctx.Value(leaseKey{}).(*lockLease); ok && held.key == key && held != current {
+		return held, true
+	}
+	delete(s.locks, key)
+	return current, false
+}
+
+// end stops the renewal of the lease and cancels the holder context.
+func (l *lockLease) end(cause error) {
+	select {
+	case <-l.stop:
+	default:
+		close(l.stop)
+	}
+	<-l.done
+	l.cancel(cause)
+}
+
+// renewLease extends the lease of the lock on key every interval until it
+// is stopped. If the lock was taken over, or could not be renewed before it
+// expired, the holder context is cancelled with ErrLockLost.
+func (s *Storage) renewLease(key string, lease *lockLease, expiresAt time.Time, interval time.Duration) {
+	defer close(lease.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lease.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		record, err := s.renewLock(ctx, key, lease.token)
+		cancel()
+		if err == nil {
+			expiresAt = record.ExpiresAt
+			s.locksMu.Lock()
+			lease.expiresAt = expiresAt
+			s.locksMu.Unlock()
+			continue
+		}
+		if errors.Is(err, ErrLockNotHeld) || !s.clock.now().Before(expiresAt) {
+			s.logger.Error("lost lock", zap.String("key", key), zap.Error(err))
+			lease.cancel(fmt.Errorf("%w: %w", ErrLockLost, err))
+			return
+		}
+		s.logger.Warn("renewing lock", zap.String("key", key), zap.Time("expires_at", expiresAt), zap.Error(err))
+	}
+}
+
+// renewLock extends the expiry of the lock on key, held with token, and
+// returns the record of its lock object.
+func (s *Storage) renewLock(ctx context.Context, key, token string) (lockRecord, error) {
+	var renewed lockRecord
+	for i, lockKey := range s.lockObjects(key) {
+		record, err := s.renewLockObject(ctx, key, lockKey, token)
+		if err != nil {
+			return record, err
+		}
+		if i == 0 {
+			renewed = record
+		}
+	}
+	return renewed, nil
+}
+
+// renewLockObject extends the expiry of the lock object lockKey of the lock
+// on key, held with token.
+func (s *Storage) renewLockObject(ctx context.Context, key, lockKey, token string) (lockRecord, error) {
+	state, err := s.readLock(ctx, lockKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state.record, fmt.Errorf("renewing %s: %w: lock was deleted", key, ErrLockNotHeld)
+	}
+	if err != nil {
+		return state.record, err
+	}
+	record := state.record
+	if record.Token != token {
+		return record, fmt.Errorf("renewing %s: %w: held by %s", key, ErrLockNotHeld, record)
+	}
+
+	record.ExpiresAt = s.clock.now().Add(s.lockExpiration)
+	err = s.transitionLock(ctx, lockKey, state, func(current lockState) error {
+		if current.record.Token != token {
+			return fmt.Errorf("renewing %s: %w: held by %s", key, ErrLockNotHeld, current.record)
+		}
+		return nil
+	}, func(ctx context.Context) error {
+		return s.writeLock(ctx, lockKey, record, false)
+	})
+	if err != nil {
+		return record, fmt.Errorf("renewing lock %s: %w", lockKey, err)
+	}
+	return record, nil
+}
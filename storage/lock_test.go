@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock_WritesOwnerRecord(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+
+	before := time.Now().UTC().Add(-time.Second)
+	require.NoError(t, s.Lock(ctx, "example.com"))
+	state, err := s.readLock(ctx, s.objLockName("example.com"))
+	require.NoError(t, err)
+	record := state.record
+
+	assert.Equal(t, "test-instance", record.Owner)
+	assert.Len(t, record.Token, 32)
+	assert.True(t, record.AcquiredAt.After(before))
+	assert.Equal(t, record.AcquiredAt.Add(s.lockExpiration), record.ExpiresAt)
+	lease, held := s.heldLock("example.com")
+	require.True(t, held)
+	assert.Equal(t, record.Token, lease.token)
+
+	require.NoError(t, s.Unlock(ctx, "example.com"))
+	_, held = s.heldLock("example.com")
+	assert.False(t, held)
+}
+
+func TestUnlock_TakenOverLock(t *testing.T) {
+	a, server := setupTestStorage(t)
+	b := connectTestStorage(t, server, "instance-b")
+	a.lockExpiration = 50 * time.Millisecond
+	b.lockExpiration = 50 * time.Millisecond
+	a.lockRenewInterval = -1 // a is paused
+	origPoll := LockPollInterval
+	LockPollInterval = 20 * time.Millisecond
+	defer func() { LockPollInterval = origPoll }()
+	ctx := context.Background()
+
+	require.NoError(t, a.Lock(ctx, "example.com"))
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, b.Lock(ctx, "example.com"))
+
+	// a's lock expired and was taken over by b: a must not release it.
+	err := a.Unlock(ctx, "example.com")
+	assert.ErrorIs(t, err, ErrLockNotHeld)
+	assert.Contains(t, err.Error(), "instance-b")
+	state, err := b.readLock(ctx, b.objLockName("example.com"))
+	require.NoError(t, err)
+	assert.Equal(t, "instance-b", state.record.Owner)
+
+	require.NoError(t, b.Unlock(ctx, "example.com"))
+	assert.False(t, lockHeld(t, b, b.objLockName("example.com")))
+}
+
+func TestUnlock_DeletesLockNextToKey(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+	require.NoError(t, s.Lock(ctx, "issue_cert_example.com"))
+	require.NoError(t, s.Unlock(ctx, "issue_cert_example.com"))
+
+	// Older versions would wait for a released lock object to expire.
+	listed, err := s.List(ctx, "", false)
+	require.NoError(t, err)
+	assert.Empty(t, listed)
+}
+
+func TestUnlock_LockOfAnotherInstance(t *testing.T) {
+	a, server := setupTestStorage(t)
+	b := connectTestStorage(t, server, "instance-b")
+	ctx := context.Background()
+
+	require.NoError(t, a.Lock(ctx, "example.com"))
+	assert.ErrorIs(t, b.Unlock(ctx, "example.com"), ErrLockNotHeld)
+	assert.True(t, a.Exists(ctx, a.objLockName("example.com")))
+	require.NoError(t, a.Unlock(ctx, "example.com"))
+}
+
+func TestLockContext_RenewsLease(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	s.lockRenewInterval = 20 * time.Millisecond
+	ctx := context.Background()
+	lockKey := s.objLockName("example.com")
+
+	holderCtx, err := s.LockContext(ctx, "example.com")
+	require.NoError(t, err)
+	first, err := s.readLock(ctx, lockKey)
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	renewed, err := s.readLock(ctx, lockKey)
+	require.NoError(t, err)
+	assert.Equal(t, first.record.Token, renewed.record.Token)
+	assert.Equal(t, first.record.AcquiredAt, renewed.record.AcquiredAt)
+	assert.True(t, renewed.record.ExpiresAt.After(first.record.ExpiresAt), "lease must be extended")
+	assert.NoError(t, holderCtx.Err())
+
+	// The renewal stops on Unlock and does not recreate the lock.
+	require.NoError(t, s.Unlock(ctx, "example.com"))
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, lockHeld(t, s, lockKey))
+	assert.ErrorIs(t, holderCtx.Err(), context.Canceled)
+}
+
+func TestLockContext_LostToTakeover(t *testing.T) {
+	a, server := setupTestStorage(t)
+	b := connectTestStorage(t, server, "instance-b")
+	a.lockRenewInterval = 20 * time.Millisecond
+	ctx := context.Background()
+
+	holderCtx, err := a.LockContext(ctx, "example.com")
+	require.NoError(t, err)
+
+	// b overwrites the lock, as if it took it over after a paused.
+	record, err := b.newLockRecord()
+	require.NoError(t, err)
+	require.NoError(t, b.writeLock(ctx, b.objLockName("example.com"), record, false))
+
+	select {
+	case <-holderCtx.Done():
+		assert.ErrorIs(t, context.Cause(holderCtx), ErrLockLost)
+		assert.ErrorIs(t, context.Cause(holderCtx), ErrLockNotHeld)
+	case <-time.After(5 * time.Second):
+		t.Fatal("holder context was not cancelled")
+	}
+	assert.ErrorIs(t, a.Unlock(ctx, "example.com"), ErrLockNotHeld)
+}
+
+func TestLockContext_RenewalKeepsFailing(t *testing.T) {
+	s, server := setupTestStorage(t)
+	s.lockExpiration = 200 * time.Millisecond
+	s.lockRenewInterval = 20 * time.Millisecond
+	ctx := context.Background()
+
+	holderCtx, err := s.LockContext(ctx, "example.com")
+	require.NoError(t, err)
+	server.Close()
+
+	select {
+	case <-holderCtx.Done():
+		cause := context.Cause(holderCtx)
+		assert.ErrorIs(t, cause, ErrLockLost)
+		assert.False(t, errors.Is(cause, ErrLockNotHeld))
+	case <-time.After(5 * time.Second):
+		t.Fatal("holder context was not cancelled")
+	}
+}
+
+func TestLock_RenewalDisabled(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	s.lockRenewInterval = -1
+	ctx := context.Background()
+
+	require.NoError(t, s.Lock(ctx, "example.com"))
+	lease, held := s.heldLock("example.com")
+	require.True(t, held)
+	select {
+	case <-lease.done:
+	default:
+		t.Fatal("no renewal expected")
+	}
+	require.NoError(t, s.Unlock(ctx, "example.com"))
+}
+
+func TestTryLock(t *testing.T) {
+	a, server := setupTestStorage(t)
+	b := connectTestStorage(t, server, "instance-b")
+	ctx := context.Background()
+
+	acquired, err := a.TryLock(ctx, "example.com")
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	// b does not wait for a's lock.
+	start := time.Now()
+	acquired, err = b.TryLock(ctx, "example.com")
+	require.NoError(t, err)
+	assert.False(t, acquired)
+	assert.Less(t, time.Since(start), LockPollInterval)
+	_, held := b.heldLock("example.com")
+	assert.False(t, held)
+
+	require.NoError(t, a.Unlock(ctx, "example.com"))
+	acquired, err = b.TryLock(ctx, "example.com")
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	require.NoError(t, b.Unlock(ctx, "example.com"))
+}
+
+func TestTryLock_ExpiredLock(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	s.lockRenewInterval = -1
+	ctx := context.Background()
+	writeExpiredLock(t, s, "example.com")
+
+	acquired, err := s.TryLock(ctx, "example.com")
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	state, err := s.readLock(ctx, s.objLockName("example.com"))
+	require.NoError(t, err)
+	assert.Equal(t, "test-instance", state.record.Owner)
+}
+
+func TestTryLock_Error(t *testing.T) {
+	s, server := setupTestStorage(t)
+	server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	acquired, err := s.TryLock(ctx, "example.com")
+	assert.Error(t, err)
+	assert.False(t, acquired)
+}
+
+// lockHeld reports whether the lock object lockKey exists and was not
+// released.
+func lockHeld(t *testing.T, s *Storage, lockKey string) bool {
+	t.Helper()
+	state, err := s.readLock(context.Background(), lockKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	require.NoError(t, err)
+	return !state.record.Released
+}
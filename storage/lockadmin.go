@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// LockInfo describes a lock, as recorded in its lock object.
+type LockInfo struct {
+	// Key is the key passed to Lock.
+	Key string `json:"key"`
+	// Owner is the instance ID of the holder. It is empty for locks written
+	// by older versions, which do not record their holder.
+	Owner string `json:"owner,omitempty"`
+	// Token identifies the acquisition of the lock.
+	Token string `json:"token,omitempty"`
+	// Fence is the fencing token of the acquisition of the lock.
+	Fence uint64 `json:"fence,omitempty"`
+	// AcquiredAt is when the lock was acquired, or written for locks written
+	// by older versions, in the time of the OSS server.
+	AcquiredAt time.Time `json:"acquired_at"`
+	// ExpiresAt is when the lock expires unless its lease is renewed.
+	ExpiresAt time.Time `json:"expires_at"`
+	// Expired reports whether the lock had expired when it was read,
+	// according to the clock of the OSS server.
+	Expired bool `json:"expired"`
+}
+
+// lockInfo describes the lock on key as read in state.
+func (s *Storage) lockInfo(key string, state lockState) LockInfo {
+	info := LockInfo{
+		Key:        key,
+		Owner:      state.record.Owner,
+		Token:      state.record.Token,
+		Fence:      state.record.Fence,
+		AcquiredAt: state.record.AcquiredAt,
+		ExpiresAt:  state.expiresAt(s.lockExpiration),
+		Expired:    state.expired(s.lockExpiration),
+	}
+	if info.AcquiredAt.IsZero() {
+		info.AcquiredAt = state.lastModified
+	}
+	return info
+}
+
+// ListLocks returns the locks that exist in the bucket, held or expired,
+// sorted by key. Released locks are left out.
+func (s *Storage) ListLocks(ctx context.Context) ([]LockInfo, error) {
+	objects, err := s.listLockObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var locks []LockInfo
+	seen := make(map[string]bool)
+	for _, object := range objects {
+		key, ok := s.lockName(object)
+		if !ok || seen[key] {
+			continue
+		}
+		seen[key] = true
+		info, err := s.InspectLock(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // released since it was listed
+		}
+		if err != nil {
+			return nil, err
+		}
+		locks = append(locks, info)
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Key < locks[j].Key })
+	return locks, nil
+}
+
+// InspectLock returns the lock on key, or fs.ErrNotExist if key is not
+// locked. In legacy mode, the lock object at its former location is
+// returned if there is no other.
+func (s *Storage) InspectLock(ctx context.Context, key string) (LockInfo, error) {
+	for _, lockKey := range s.lockObjects(key) {
+		state, err := s.readLock(ctx, lockKey)
+		if errors.Is(err, fs.ErrNotExist) || err == nil && state.record.Released {
+			continue
+		}
+		if err != nil {
+			return LockInfo{}, err
+		}
+		return s.lockInfo(key, state), nil
+	}
+	return LockInfo{}, fs.ErrNotExist
+}
+
+// ForceUnlock releases the lock on key whoever holds it, e.g. after its
+// holder crashed, and returns the lock released. It returns fs.ErrNotExist
+// if key is not locked.
+//
+// The holder is not notified: if it is still running, it finds out it lost
+// the lock when renewing its lease, and its writes can be rejected with
+// fencing tokens.
+func (s *Storage) ForceUnlock(ctx context.Context, key string) (LockInfo, error) {
+	var (
+		info  LockInfo
+		found bool
+	)
+	for _, lockKey := range s.lockObjects(key) {
+		released, err := s.forceUnlockObject(ctx, key, lockKey)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return LockInfo{}, err
+		}
+		if !found {
+			info, found = released, true
+		}
+	}
+	if !found {
+		return LockInfo{}, fs.ErrNotExist
+	}
+	s.logger.Warn("forced unlock",
+		zap.String("key", key),
+		zap.String("owner", info.Owner),
+		zap.Time("expires_at", info.ExpiresAt))
+	return info, nil
+}
+
+// forceUnlockObject releases the lock object lockKey of the lock on key
+// (see releaseLockObject) and returns the lock it recorded.
+func (s *Storage) forceUnlockObject(ctx context.Context, key, lockKey string) (LockInfo, error) {
+	for {
+		state, err := s.readLock(ctx, lockKey)
+		if err == nil && state.record.Released {
+			err = fs.ErrNotExist
+		}
+		if err != nil {
+			return LockInfo{}, err
+		}
+
+		err = s.transitionLock(ctx, lockKey, state, func(lockState) error {
+			return nil
+		}, func(ctx context.Context) error {
+			return s.releaseLockObject(ctx, key, lockKey, state.record)
+		})
+		if err == nil {
+			return s.lockInfo(key, state), nil
+		}
+		if !errors.Is(err, errLockChanged) {
+			return LockInfo{}, fmt.Errorf("force unlocking %s: %w", key, err)
+		}
+
+		// Renewed, taken over or released concurrently: check it again
+		if err := s.lockBackoff.wait(ctx, s.lockBackoff.interval(0)); err != nil {
+			return LockInfo{}, err
+		}
+	}
+}
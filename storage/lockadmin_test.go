@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListLocks(t *testing.T) {
+	a, server := setupTestStorage(t)
+	b := connectTestStorage(t, server, "instance-b")
+	ctx := context.Background()
+
+	require.NoError(t, a.Lock(ctx, "issue_cert_a.com"))
+	require.NoError(t, b.Lock(ctx, "certs/b.com"))
+	state := writeExpiredLock(t, a, "expired.com")
+	_, err := a.client.PutObject(ctx, &oss.PutObjectRequest{
+		Bucket: oss.Ptr(a.bucketName),
+		Key:    oss.Ptr(a.objLockName("legacy.com")),
+		Body:   bytes.NewReader(nil),
+	})
+	require.NoError(t, err)
+	// Neither claims nor other objects are locks.
+	_, err = a.claimLock(ctx, a.objLockName("expired.com"), state.etag)
+	require.NoError(t, err)
+	require.NoError(t, a.Store(ctx, "certs/b.com.crt", []byte("cert")))
+
+	locks, err := a.ListLocks(ctx)
+	require.NoError(t, err)
+	var keys []string
+	for _, lock := range locks {
+		keys = append(keys, lock.Key)
+	}
+	require.Equal(t, []string{"certs/b.com", "expired.com", "issue_cert_a.com", "legacy.com"}, keys)
+
+	assert.Equal(t, "instance-b", locks[0].Owner)
+	assert.NotEmpty(t, locks[0].Token)
+	assert.NotZero(t, locks[0].Fence)
+	assert.False(t, locks[0].Expired)
+	assert.Equal(t, locks[0].AcquiredAt.Add(b.lockExpiration), locks[0].ExpiresAt)
+
+	assert.Equal(t, "crashed", locks[1].Owner)
+	assert.True(t, locks[1].Expired)
+
+	assert.Equal(t, "test-instance", locks[2].Owner)
+
+	assert.Empty(t, locks[3].Owner, "legacy locks have no owner")
+	assert.False(t, locks[3].AcquiredAt.IsZero())
+	assert.Equal(t, locks[3].AcquiredAt.Add(a.lockExpiration), locks[3].ExpiresAt)
+}
+
+func TestInspectLock(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+
+	_, err := s.InspectLock(ctx, "example.com")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, s.Lock(ctx, "example.com"))
+	info, err := s.InspectLock(ctx, "example.com")
+	require.NoError(t, err)
+	fence, _ := s.FencingToken("example.com")
+	assert.Equal(t, "example.com", info.Key)
+	assert.Equal(t, "test-instance", info.Owner)
+	assert.Equal(t, fence, info.Fence)
+	assert.WithinDuration(t, time.Now().Add(s.lockExpiration), info.ExpiresAt, 5*time.Second)
+}
+
+func TestForceUnlock(t *testing.T) {
+	holder, server := setupTestStorage(t)
+	holder.lockRenewInterval = 20 * time.Millisecond
+	admin := connectTestStorage(t, server, "admin")
+	ctx := context.Background()
+
+	holderCtx, err := holder.LockContext(ctx, "example.com")
+	require.NoError(t, err)
+
+	info, err := admin.ForceUnlock(ctx, "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "test-instance", info.Owner)
+	assert.False(t, lockHeld(t, admin, admin.objLockName("example.com")))
+
+	// The holder finds out when renewing its lease.
+	select {
+	case <-holderCtx.Done():
+		assert.ErrorIs(t, context.Cause(holderCtx), ErrLockLost)
+	case <-time.After(5 * time.Second):
+		t.Fatal("holder context was not cancelled")
+	}
+	assert.NoError(t, holder.Unlock(ctx, "example.com"))
+
+	_, err = admin.ForceUnlock(ctx, "example.com")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestForceUnlock_ExpiredLock(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+	writeExpiredLock(t, s, "example.com")
+
+	info, err := s.ForceUnlock(ctx, "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "crashed", info.Owner)
+	assert.True(t, info.Expired)
+	require.NoError(t, s.Lock(ctx, "example.com"))
+	require.NoError(t, s.Unlock(ctx, "example.com"))
+}
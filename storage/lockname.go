@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// lockSuffix ends the names of lock objects.
+const lockSuffix = ".lock"
+
+// validateLockPrefix checks the lock namespace of config.
+func validateLockPrefix(config Config) error {
+	if strings.HasPrefix(config.LockPrefix, "/") {
+		return errors.New("LockPrefix must not start with /")
+	}
+	if config.LegacyLocks && config.LockPrefix == "" {
+		return errors.New("LegacyLocks requires LockPrefix")
+	}
+	return nil
+}
+
+// objLockName returns the name of the lock object of key. Without a lock
+// prefix, the lock object sits next to key. Otherwise key is escaped, so
+// that the lock objects of all keys are direct children of the prefix.
+func (s *Storage) objLockName(key string) string {
+	if s.lockPrefix == "" {
+		return legacyLockName(key)
+	}
+	return s.lockPrefix + url.PathEscape(key) + lockSuffix
+}
+
+// legacyLockName returns the name of the lock object of key used by older
+// versions, and without a lock prefix.
+func legacyLockName(key string) string {
+	return key + lockSuffix
+}
+
+// lockObjects returns the lock objects that make up the lock on key: the
+// lock object of key, and in legacy mode the lock object at its former
+// location, which instances running older versions use.
+func (s *Storage) lockObjects(key string) []string {
+	if !s.legacyLocks {
+		return []string{s.objLockName(key)}
+	}
+	return []string{s.objLockName(key), legacyLockName(key)}
+}
+
+// lockName returns the key locked by the lock object lockKey, if it is a
+// lock object. In legacy mode, lock objects at their former location are
+// recognised too.
+func (s *Storage) lockName(lockKey string) (string, bool) {
+	if s.lockPrefix == "" {
+		return strings.CutSuffix(lockKey, lockSuffix)
+	}
+	if escaped, ok := strings.CutPrefix(lockKey, s.lockPrefix); ok {
+		escaped, ok = strings.CutSuffix(escaped, lockSuffix)
+		if ok && !strings.Contains(escaped, "/") {
+			key, err := url.PathUnescape(escaped)
+			return key, err == nil
+		}
+	}
+	if !s.legacyLocks {
+		return "", false
+	}
+	return strings.CutSuffix(lockKey, lockSuffix)
+}
+
+// listLockObjects returns the objects which may be lock objects or claims
+// on them. With a lock prefix, only the prefix is listed, unless in legacy
+// mode, where the lock objects at their former location are spread over
+// the bucket, next to their key.
+func (s *Storage) listLockObjects(ctx context.Context) ([]string, error) {
+	if s.lockPrefix == "" || s.legacyLocks {
+		return s.List(ctx, "", true)
+	}
+	return s.listPrefix(ctx, s.lockPrefix, true)
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObjLockName(t *testing.T) {
+	tests := []struct {
+		prefix string
+		key    string
+		want   string
+	}{
+		{"", "issue_cert_example.com", "issue_cert_example.com.lock"},
+		{"", "certificates/example.com/example.com.crt", "certificates/example.com/example.com.crt.lock"},
+		{"locks/", "issue_cert_example.com", "locks/issue_cert_example.com.lock"},
+		{"locks/", "certificates/example.com/example.com.crt", "locks/certificates%2Fexample.com%2Fexample.com.crt.lock"},
+		{"locks/", "100%/a b", "locks/100%25%2Fa%20b.lock"},
+		{"locks/", "*.example.com", "locks/%2A.example.com.lock"},
+	}
+	for _, tt := range tests {
+		s := &Storage{lockPrefix: tt.prefix}
+		lockKey := s.objLockName(tt.key)
+		assert.Equal(t, tt.want, lockKey)
+		key, ok := s.lockName(lockKey)
+		assert.True(t, ok, lockKey)
+		assert.Equal(t, tt.key, key)
+	}
+}
+
+func TestLockName(t *testing.T) {
+	s := &Storage{lockPrefix: "locks/"}
+	for _, lockKey := range []string{
+		"locks/a.crt",
+		"locks/a/b.lock",
+		"locks/bad%zz.lock",
+		"example.com.lock",
+	} {
+		_, ok := s.lockName(lockKey)
+		assert.False(t, ok, lockKey)
+	}
+
+	s.legacyLocks = true
+	key, ok := s.lockName("certificates/example.com.lock")
+	assert.True(t, ok)
+	assert.Equal(t, "certificates/example.com", key)
+}
+
+func TestValidateLockPrefix(t *testing.T) {
+	assert.NoError(t, validateLockPrefix(Config{}))
+	assert.NoError(t, validateLockPrefix(Config{LockPrefix: "locks/", LegacyLocks: true}))
+	assert.Error(t, validateLockPrefix(Config{LockPrefix: "/locks/"}))
+	assert.Error(t, validateLockPrefix(Config{LegacyLocks: true}))
+}
+
+func TestLock_LockPrefix(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	s.lockPrefix = "locks/"
+	ctx := context.Background()
+	key := "certificates/example.com/example.com.crt"
+
+	require.NoError(t, s.Lock(ctx, key))
+	assert.True(t, s.Exists(ctx, "locks/certificates%2Fexample.com%2Fexample.com.crt.lock"))
+	assert.False(t, s.Exists(ctx, key+".lock"))
+	listed, err := s.List(ctx, "certificates", true)
+	require.NoError(t, err)
+	assert.Empty(t, listed, "lock objects are kept apart from the data")
+
+	locks, err := s.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	assert.Equal(t, key, locks[0].Key)
+
+	require.NoError(t, s.Unlock(ctx, key))
+	assert.False(t, lockHeld(t, s, s.objLockName(key)))
+}
+
+func TestListLockObjects_LockPrefix(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		prefixes []string
+	)
+	mock := mockOSSHandler(time.Now)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if query := r.URL.Query(); query.Get("list-type") == "2" {
+			mu.Lock()
+			prefixes = append(prefixes, query.Get("prefix"))
+			mu.Unlock()
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	s := connectTestStorage(t, server, "test-instance")
+	s.lockPrefix = "locks/"
+	ctx := context.Background()
+
+	require.NoError(t, s.Store(ctx, "certificates/example.com/example.com.crt", []byte("cert")))
+	require.NoError(t, s.Store(ctx, "other.com.lock", []byte("not ours")))
+	require.NoError(t, s.Lock(ctx, "example.com"))
+	objects, err := s.listLockObjects(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{s.objLockName("example.com")}, objects)
+
+	_, err = s.ListLocks(ctx)
+	require.NoError(t, err)
+	_, err = s.ReapLocks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"locks/", "locks/", "locks/"}, prefixes, "only the lock prefix is listed")
+
+	// In legacy mode, lock objects may sit next to their key.
+	s.legacyLocks = true
+	objects, err = s.listLockObjects(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, objects, "other.com.lock")
+	require.NoError(t, s.Unlock(ctx, "example.com"))
+}
+
+func TestLock_LegacyLocks(t *testing.T) {
+	old, server := setupTestStorage(t)
+	upgraded := connectTestStorage(t, server, "upgraded")
+	upgraded.lockPrefix = "locks/"
+	upgraded.legacyLocks = true
+	migrated := connectTestStorage(t, server, "migrated")
+	migrated.lockPrefix = "locks/"
+	ctx := context.Background()
+
+	// A lock held by an older version is honoured.
+	require.NoError(t, old.Lock(ctx, "example.com"))
+	acquired, err := upgraded.TryLock(ctx, "example.com")
+	require.NoError(t, err)
+	assert.False(t, acquired)
+	assert.False(t, lockHeld(t, upgraded, "locks/example.com.lock"), "released when the lock was not acquired")
+	require.NoError(t, old.Unlock(ctx, "example.com"))
+
+	// A lock held in legacy mode excludes both older versions and the
+	// instances which no longer use the former location.
+	require.NoError(t, upgraded.Lock(ctx, "example.com"))
+	assert.True(t, upgraded.Exists(ctx, "locks/example.com.lock"))
+	assert.True(t, upgraded.Exists(ctx, "example.com.lock"))
+	acquired, err = old.TryLock(ctx, "example.com")
+	require.NoError(t, err)
+	assert.False(t, acquired)
+	acquired, err = migrated.TryLock(ctx, "example.com")
+	require.NoError(t, err)
+	assert.False(t, acquired)
+
+	locks, err := upgraded.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	assert.Equal(t, "upgraded", locks[0].Owner)
+
+	fence, _ := upgraded.FencingToken("example.com")
+	record, err := upgraded.renewLock(ctx, "example.com", mustLease(t, upgraded, "example.com").token)
+	require.NoError(t, err)
+	assert.Equal(t, fence, record.Fence)
+
+	require.NoError(t, upgraded.Unlock(ctx, "example.com"))
+	assert.False(t, lockHeld(t, upgraded, "locks/example.com.lock"))
+	assert.False(t, upgraded.Exists(ctx, "example.com.lock"), "deleted for older versions")
+}
+
+func TestForceUnlock_LegacyLocks(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	s.lockPrefix = "locks/"
+	s.legacyLocks = true
+	ctx := context.Background()
+	require.NoError(t, s.Lock(ctx, "example.com"))
+
+	info, err := s.ForceUnlock(ctx, "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "test-instance", info.Owner)
+	assert.False(t, lockHeld(t, s, "locks/example.com.lock"))
+	assert.False(t, s.Exists(ctx, "example.com.lock"))
+}
+
+// mustLease returns the lease of the lock held by s on key.
+func mustLease(t *testing.T, s *Storage, key string) *lockLease {
+	t.Helper()
+	lease, ok := s.heldLock(key)
+	require.True(t, ok, "lock on %s not held", key)
+	return lease
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// lockQueue serialises the goroutines of a Storage locking the same key, so
+// that only one of them at a time contends for the lock object on OSS while
+// the others wait in the process.
+type lockQueue struct {
+	// busy is set while a goroutine acquires or holds the lock.
+	busy bool
+	// waiters is the number of goroutines waiting for busy to be cleared.
+	waiters int
+	// wake is closed when busy is cleared.
+	wake chan struct{}
+}
+
+// enterLockQueue waits until no other goroutine of s acquires or holds the
+// lock on key, or until the lease of the local holder expired, e.g. because
+// it stopped renewing it without releasing the lock. It then lets the
+// caller contend for the lock object, until leaveLockQueue. The caller
+// takes the place of a local holder whose lease expired, whose Unlock then
+// leaves the queue to the caller. It returns ErrLockWaitTimeout if it is
+// still waiting when timeout fires.
+func (s *Storage) enterLockQueue(ctx context.Context, key string, timeout <-chan time.Time) error {
+	var expired *lockLease
+	s.locksMu.Lock()
+	defer func() {
+		s.locksMu.Unlock()
+		if expired != nil {
+			expired.end(ErrLockLost)
+		}
+	}()
+	q := s.lockQueue(key)
+
+	for q.busy {
+		remaining, held := s.localLeaseRemaining(key)
+		if held && remaining <= 0 {
+			// The local holder lost the lock: contend on OSS, which
+			// decides who holds the lock.
+			expired = s.supersedeLease(key)
+			return nil
+		}
+
+		wake := q.wake
+		var timer *time.Timer
+		var expiry <-chan time.Time
+		if held {
+			timer = time.NewTimer(remaining)
+			expiry = timer.C
+		}
+		q.waiters++
+		s.locksMu.Unlock()
+		var err error
+		select {
+		case <-wake:
+		case <-expiry:
+		case <-timeout:
+			err = ErrLockWaitTimeout
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		s.locksMu.Lock()
+		q.waiters--
+		if err != nil {
+			s.dropLockQueue(key, q)
+			return err
+		}
+	}
+	q.busy = true
+	return nil
+}
+
+// tryEnterLockQueue is enterLockQueue without waiting: it reports false if
+// another goroutine of s acquires or holds the lock on key.
+func (s *Storage) tryEnterLockQueue(key string) bool {
+	var expired *lockLease
+	s.locksMu.Lock()
+	defer func() {
+		s.locksMu.Unlock()
+		if expired != nil {
+			expired.end(ErrLockLost)
+		}
+	}()
+	q := s.lockQueue(key)
+	if q.busy {
+		if remaining, held := s.localLeaseRemaining(key); !held || remaining > 0 {
+			s.dropLockQueue(key, q)
+			return false
+		}
+		expired = s.supersedeLease(key)
+	}
+	q.busy = true
+	return true
+}
+
+// leaveLockQueue lets the next goroutine of s waiting for the lock on key
+// contend for it.
+func (s *Storage) leaveLockQueue(key string) {
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+	q, ok := s.queues[key]
+	if !ok || !q.busy {
+		return
+	}
+	q.busy = false
+	close(q.wake)
+	q.wake = make(chan struct{})
+	s.dropLockQueue(key, q)
+}
+
+// lockQueue returns the queue of key. s.locksMu must be held.
+func (s *Storage) lockQueue(key string) *lockQueue {
+	q, ok := s.queues[key]
+	if !ok {
+		if s.queues == nil {
+			s.queues = make(map[string]*lockQueue)
+		}
+		q = &lockQueue{wake: make(chan struct{})}
+		s.queues[key] = q
+	}
+	return q
+}
+
+// dropLockQueue forgets the queue q of key once unused. s.locksMu must be
+// held.
+func (s *Storage) dropLockQueue(key string, q *lockQueue) {
+	if !q.busy && q.waiters == 0 {
+		delete(s.queues, key)
+	}
+}
+
+// localLeaseRemaining returns the time left until the lease of the lock held
+// by s on key expires, according to the clock of the server, if s holds the
+// lock. s.locksMu must be held.
+func (s *Storage) localLeaseRemaining(key string) (time.Duration, bool) {
+	lease, ok := s.locks[key]
+	if !ok {
+		return 0, false
+	}
+	return lease.expiresAt.Sub(s.clock.now()), true
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countLockRequests counts the requests to lock objects in *n.
+func countLockRequests(h http.Handler, n *atomic.Int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".lock") {
+			n.Add(1)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func TestLock_CoalescesLocalWaiters(t *testing.T) {
+	var requests atomic.Int64
+	server := httptest.NewServer(countLockRequests(mockOSSHandler(time.Now), &requests))
+	t.Cleanup(server.Close)
+	other := connectTestStorage(t, server, "other-instance")
+	s := connectTestStorage(t, server, "test-instance")
+	s.lockBackoff = lockBackoff{initial: 10 * time.Millisecond, multiplier: 1, jitter: -1}
+	ctx := context.Background()
+
+	require.NoError(t, other.Lock(ctx, "example.com"))
+
+	const goroutines = 5
+	var (
+		wg       sync.WaitGroup
+		holders  atomic.Int32
+		overlaps atomic.Int32
+	)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !assert.NoError(t, s.Lock(ctx, "example.com")) {
+				return
+			}
+			if holders.Add(1) > 1 {
+				overlaps.Add(1)
+			}
+			time.Sleep(5 * time.Millisecond)
+			holders.Add(-1)
+			assert.NoError(t, s.Unlock(ctx, "example.com"))
+		}()
+	}
+
+	// Only one goroutine polls the lock held by the other instance: about
+	// two requests (PutObject, GetObject) every 10ms.
+	time.Sleep(50 * time.Millisecond)
+	requests.Store(0)
+	time.Sleep(200 * time.Millisecond)
+	assert.LessOrEqual(t, requests.Load(), int64(2*25), "polled by more than one goroutine")
+
+	require.NoError(t, other.Unlock(ctx, "example.com"))
+	wg.Wait()
+	assert.Zero(t, overlaps.Load())
+	assert.Empty(t, s.queues)
+	assert.False(t, lockHeld(t, s, s.objLockName("example.com")))
+}
+
+func TestTryLock_HeldLocally(t *testing.T) {
+	var requests atomic.Int64
+	server := httptest.NewServer(countLockRequests(mockOSSHandler(time.Now), &requests))
+	t.Cleanup(server.Close)
+	s := connectTestStorage(t, server, "test-instance")
+	ctx := context.Background()
+
+	require.NoError(t, s.Lock(ctx, "example.com"))
+	requests.Store(0)
+	acquired, err := s.TryLock(ctx, "example.com")
+	require.NoError(t, err)
+	assert.False(t, acquired)
+	assert.Zero(t, requests.Load(), "no request while another goroutine holds the lock")
+
+	require.NoError(t, s.Unlock(ctx, "example.com"))
+	acquired, err = s.TryLock(ctx, "example.com")
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	require.NoError(t, s.Unlock(ctx, "example.com"))
+	assert.Empty(t, s.queues)
+}
+
+func TestLock_LocalWaiterCancelled(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+	require.NoError(t, s.Lock(ctx, "example.com"))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Lock(timeoutCtx, "example.com"), context.DeadlineExceeded)
+
+	require.NoError(t, s.Unlock(ctx, "example.com"))
+	assert.Empty(t, s.queues)
+	require.NoError(t, s.Lock(ctx, "example.com"))
+	require.NoError(t, s.Unlock(ctx, "example.com"))
+}
+
+func TestLock_LocalWaiterMaxWait(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	s.lockBackoff.maxWait = 100 * time.Millisecond
+	ctx := context.Background()
+	require.NoError(t, s.Lock(ctx, "example.com"))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	assert.ErrorIs(t, s.Lock(timeoutCtx, "example.com"), ErrLockWaitTimeout)
+	assert.Less(t, time.Since(start), time.Second)
+
+	require.NoError(t, s.Unlock(ctx, "example.com"))
+	assert.Empty(t, s.queues)
+}
+
+func TestLock_LocalHolderLeaseExpired(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	s.lockExpiration = 100 * time.Millisecond
+	s.lockRenewInterval = -1 // the holder stopped renewing its lease
+	s.lockBackoff = lockBackoff{initial: 10 * time.Millisecond, jitter: -1}
+	ctx := context.Background()
+	holderCtx, err := s.LockContext(ctx, "example.com")
+	require.NoError(t, err)
+
+	// The waiter contends on OSS once the lease of the holder expired,
+	// without waiting for it to Unlock.
+	waiterCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.lockExpiration = time.Minute
+	start := time.Now()
+	require.NoError(t, s.Lock(waiterCtx, "example.com"))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.ErrorIs(t, context.Cause(holderCtx), ErrLockLost)
+	waiterToken := mustLease(t, s, "example.com").token
+
+	// The Unlock of the former holder leaves the lock of the waiter alone.
+	assert.ErrorIs(t, s.Unlock(holderCtx, "example.com"), ErrLockNotHeld)
+	assert.Equal(t, waiterToken, mustLease(t, s, "example.com").token)
+	state, err := s.readLock(ctx, s.objLockName("example.com"))
+	require.NoError(t, err)
+	assert.Equal(t, waiterToken, state.record.Token)
+	acquired, err := s.TryLock(ctx, "example.com")
+	require.NoError(t, err)
+	assert.False(t, acquired, "the waiter still holds its place in the queue")
+
+	require.NoError(t, s.Unlock(waiterCtx, "example.com"))
+	assert.Empty(t, s.queues)
+	assert.False(t, lockHeld(t, s, s.objLockName("example.com")))
+}
+
+func TestUnlock_AfterLocalTakeover(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	s.lockExpiration = 100 * time.Millisecond
+	s.lockRenewInterval = -1
+	s.lockBackoff = lockBackoff{initial: 10 * time.Millisecond, jitter: -1}
+	ctx := context.Background()
+	require.NoError(t, s.Lock(ctx, "example.com"))
+	s.lockExpiration = time.Minute
+	require.NoError(t, s.Lock(ctx, "example.com"))
+
+	// The new holder unlocks like CertMagic does, with a context unrelated
+	// to the acquisition.
+	require.NoError(t, s.Unlock(context.WithoutCancel(ctx), "example.com"))
+	_, held := s.heldLock("example.com")
+	assert.False(t, held)
+	assert.False(t, lockHeld(t, s, s.objLockName("example.com")))
+	acquired, err := s.TryLock(ctx, "example.com")
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	require.NoError(t, s.Unlock(ctx, "example.com"))
+	assert.Empty(t, s.queues)
+}
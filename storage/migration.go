@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"go.uber.org/zap"
+)
+
+// metaEncryption is the object metadata (x-oss-meta-certmagic-encryption)
+// recording how an object was encrypted by Store.
+const metaEncryption = "certmagic-encryption"
+
+// Encryption schemes recorded in the metaEncryption metadata.
+const (
+	encryptionNone     = "none"
+	encryptionTink     = "tink"
+	encryptionEnvelope = "envelope"
+)
+
+// errCleartextObject is returned when loading an object stored in cleartext
+// while encryption is configured and MigrateCleartext is disabled.
+var errCleartextObject = errors.New("object is stored in cleartext (enable cleartext migration to load it)")
+
+// encryptionScheme returns the scheme objects are encrypted with by Store.
+func (s *Storage) encryptionScheme() string {
+	switch s.aead.(type) {
+	case *cleartext, cleartext:
+		return encryptionNone
+	case *envelopeAEAD:
+		return encryptionEnvelope
+	default:
+		return encryptionTink
+	}
+}
+
+// decrypt decrypts data loaded from key, which was stored with the given
+// encryption scheme. scheme is empty for objects written before schemes were
+// recorded. legacy reports whether the object was found in cleartext while
+// encryption is configured.
+func (s *Storage) decrypt(key string, data []byte, scheme string) (plaintext []byte, legacy bool, err error) {
+	current := s.encryptionScheme()
+	switch {
+	case scheme == encryptionNone && current != encryptionNone:
+		if !s.migrateCleartext {
+			return nil, false, errCleartextObject
+		}
+		return data, true, nil
+	case scheme != "" && scheme != encryptionNone && current == encryptionNone:
+		return nil, false, fmt.Errorf("object is encrypted (%s) but no encryption key is configured", scheme)
+	}
+
+	plaintext, err = s.aead.Decrypt(data, []byte(key))
+	if err == nil {
+		return plaintext, false, nil
+	}
+	// An untagged object that fails to decrypt and does not carry an envelope
+	// header predates encryption.
+	if scheme == "" && s.migrateCleartext && !isEnvelope(data) {
+		return data, true, nil
+	}
+	return nil, false, err
+}
+
+// rewriteCleartext stores again the cleartext object key, encrypted, unless
+// it was modified since it was loaded with the given ETag. Failures are only
+// logged: the object stays readable in cleartext and is retried next time.
+func (s *Storage) rewriteCleartext(ctx context.Context, key string, value []byte, etag string) {
+	head, err := s.client.HeadObject(ctx, &oss.HeadObjectRequest{
+		Bucket: oss.Ptr(s.bucketName),
+		Key:    oss.Ptr(s.objName(key)),
+	})
+	if err != nil {
+		s.logger.Warn("checking cleartext object before rewriting it", zap.String("key", key), zap.Error(err))
+		return
+	}
+	if oss.ToString(head.ETag) != etag {
+		// modified concurrently, most likely rewritten already
+		return
+	}
+	if err := s.Store(ctx, key, value); err != nil {
+		s.logger.Warn("rewriting cleartext object encrypted", zap.String("key", key), zap.Error(err))
+		return
+	}
+	s.logger.Info("rewrote cleartext object encrypted", zap.String("key", key))
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/google/tink/go/tink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loadRaw returns the stored bytes and metadata of key, bypassing decryption.
+func loadRaw(t *testing.T, s *Storage, key string) ([]byte, map[string]string) {
+	t.Helper()
+	result, err := s.client.GetObject(context.Background(), &oss.GetObjectRequest{
+		Bucket: oss.Ptr(s.bucketName),
+		Key:    oss.Ptr(key),
+	})
+	require.NoError(t, err)
+	defer result.Body.Close()
+	data, err := io.ReadAll(result.Body)
+	require.NoError(t, err)
+	return data, result.Metadata
+}
+
+// putUntagged stores value at key without any encryption scheme metadata,
+// like versions which did not record it.
+func putUntagged(t *testing.T, s *Storage, key string, value []byte) {
+	t.Helper()
+	_, err := s.client.PutObject(context.Background(), &oss.PutObjectRequest{
+		Bucket: oss.Ptr(s.bucketName),
+		Key:    oss.Ptr(key),
+		Body:   bytes.NewReader(value),
+	})
+	require.NoError(t, err)
+}
+
+func TestStore_TagsEncryptionScheme(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+	_, kek := newTestKEK(t)
+
+	tests := map[string]struct {
+		aead   tink.AEAD
+		scheme string
+	}{
+		"cleartext": {new(cleartext), encryptionNone},
+		"tink":      {newRotatingKeyset(t).aead(), encryptionTink},
+		"envelope":  {&envelopeAEAD{kek: kek}, encryptionEnvelope},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			s.aead = tt.aead
+			require.NoError(t, s.Store(ctx, name, []byte("value")))
+			_, metadata := loadRaw(t, s, name)
+			assert.Equal(t, tt.scheme, metadata[metaEncryption])
+		})
+	}
+}
+
+func TestLoad_CleartextObject(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+	key := "certs/example.com/cert.pem"
+	content := []byte("-----BEGIN CERTIFICATE-----")
+	require.NoError(t, s.Store(ctx, key, content))
+	putUntagged(t, s, "legacy.pem", content)
+
+	s.aead = newRotatingKeyset(t).aead()
+
+	// Without migration, cleartext objects are refused.
+	_, err := s.Load(ctx, key)
+	assert.ErrorIs(t, err, errCleartextObject)
+	_, err = s.Load(ctx, "legacy.pem")
+	assert.Error(t, err)
+
+	// With migration, they are returned as is and left untouched.
+	s.migrateCleartext = true
+	for _, k := range []string{key, "legacy.pem"} {
+		loaded, err := s.Load(ctx, k)
+		require.NoError(t, err, k)
+		assert.Equal(t, content, loaded)
+		raw, _ := loadRaw(t, s, k)
+		assert.Equal(t, content, raw)
+	}
+}
+
+func TestLoad_CleartextObject_Rewrite(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+	content := []byte("-----BEGIN CERTIFICATE-----")
+	require.NoError(t, s.Store(ctx, "tagged.pem", content))
+	putUntagged(t, s, "legacy.pem", content)
+
+	_, kek := newTestKEK(t)
+	s.aead = &envelopeAEAD{kek: kek}
+	s.migrateCleartext = true
+	s.rewriteCleartextObjects = true
+
+	for _, key := range []string{"tagged.pem", "legacy.pem"} {
+		loaded, err := s.Load(ctx, key)
+		require.NoError(t, err, key)
+		assert.Equal(t, content, loaded)
+
+		raw, metadata := loadRaw(t, s, key)
+		assert.Equal(t, encryptionEnvelope, metadata[metaEncryption], key)
+		assert.True(t, isEnvelope(raw), key)
+
+		// Encrypted from now on, even without migration.
+		s.migrateCleartext = false
+		loaded, err = s.Load(ctx, key)
+		require.NoError(t, err, key)
+		assert.Equal(t, content, loaded)
+		s.migrateCleartext = true
+	}
+}
+
+func TestLoad_EncryptedObjectNotMistakenForCleartext(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+	_, kek := newTestKEK(t)
+	s.aead = &envelopeAEAD{kek: kek}
+	require.NoError(t, s.Store(ctx, "cert.pem", []byte("secret")))
+	raw, _ := loadRaw(t, s, "cert.pem")
+	putUntagged(t, s, "untagged.pem", raw)
+
+	// Under another KEK, envelope objects fail to decrypt instead of being
+	// returned as cleartext, tagged or not.
+	_, other := newTestKEK(t)
+	s.aead = &envelopeAEAD{kek: other}
+	s.migrateCleartext = true
+	_, err := s.Load(ctx, "cert.pem")
+	assert.Error(t, err)
+	_, err = s.Load(ctx, "untagged.pem")
+	assert.Error(t, err)
+
+	// Without any key, encrypted objects are refused rather than returned.
+	s.aead = new(cleartext)
+	_, err = s.Load(ctx, "cert.pem")
+	assert.Error(t, err)
+}
+
+func TestNewStorage_RewriteCleartextRequiresMigrate(t *testing.T) {
+	_, err := NewStorage(context.Background(), Config{
+		AccessKeyID:      "test-ak",
+		AccessKeySecret:  "test-sk",
+		RewriteCleartext: true,
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefix(t *testing.T) {
+	bucket, server := setupTestStorage(t)
+	staging := connectTestStorage(t, server, "staging")
+	staging.prefix = "staging/"
+	production := connectTestStorage(t, server, "production")
+	production.prefix = "tenants/a/"
+	ctx := context.Background()
+
+	key := "certificates/acme/example.com/example.com.crt"
+	require.NoError(t, staging.Store(ctx, key, []byte("staging cert")))
+	require.NoError(t, production.Store(ctx, key, []byte("production cert")))
+
+	objects, err := bucket.List(ctx, "", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"staging/" + key, "tenants/a/" + key}, objects)
+
+	loaded, err := staging.Load(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("staging cert"), loaded)
+	assert.True(t, production.Exists(ctx, key))
+	info, err := production.Stat(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, key, info.Key)
+	assert.EqualValues(t, len("production cert"), info.Size)
+	info, err = production.Stat(ctx, "certificates")
+	require.NoError(t, err)
+	assert.False(t, info.IsTerminal)
+
+	listed, err := production.List(ctx, "", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{key}, listed)
+	listed, err = production.List(ctx, "", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"certificates"}, listed)
+	listed, err = production.List(ctx, "certificates/acme", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"certificates/acme/example.com"}, listed)
+
+	// Locks are scoped by the prefix.
+	acquired, err := staging.TryLock(ctx, key)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	acquired, err = production.TryLock(ctx, key)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	assert.True(t, bucket.Exists(ctx, "staging/"+key+".lock"))
+	locks, err := staging.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	assert.Equal(t, key, locks[0].Key)
+	assert.Equal(t, "staging", locks[0].Owner)
+	require.NoError(t, staging.Unlock(ctx, key))
+	require.NoError(t, production.Unlock(ctx, key))
+
+	require.NoError(t, staging.Delete(ctx, "certificates"))
+	assert.False(t, staging.Exists(ctx, key))
+	assert.True(t, production.Exists(ctx, key), "other prefixes are not deleted")
+}
+
+func TestPrefix_LockPrefix(t *testing.T) {
+	bucket, server := setupTestStorage(t)
+	s := connectTestStorage(t, server, "test-instance")
+	s.prefix = "production/"
+	s.lockPrefix = "locks/"
+	ctx := context.Background()
+
+	require.NoError(t, s.Lock(ctx, "certificates/example.com"))
+	assert.True(t, bucket.Exists(ctx, "production/locks/certificates%2Fexample.com.lock"))
+	locks, err := s.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	assert.Equal(t, "certificates/example.com", locks[0].Key)
+	require.NoError(t, s.Unlock(ctx, "certificates/example.com"))
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// reapJitter is the fraction by which the interval between two passes of
+// the reaper is randomly shortened or lengthened, so that the instances
+// sharing a bucket do not reap it at the same time.
+const reapJitter = 0.2
+
+// RunReaper deletes the stale lock objects of the bucket every
+// Config.LockReapInterval until ctx is done (see ReapLocks). It returns at
+// once if LockReapInterval is zero.
+func (s *Storage) RunReaper(ctx context.Context) {
+	if s.lockReapInterval <= 0 {
+		return
+	}
+	for {
+		select {
+		case <-time.After(reapDelay(s.lockReapInterval, rand.Float64())):
+		case <-ctx.Done():
+			return
+		}
+
+		n, err := s.ReapLocks(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.logger.Warn("reaping stale locks", zap.Int("deleted", n), zap.Error(err))
+		} else if n > 0 {
+			s.logger.Info("reaped stale locks", zap.Int("deleted", n))
+		}
+	}
+}
+
+// reapDelay returns the delay before the next pass of the reaper, given a
+// random number in [0, 1).
+func reapDelay(interval time.Duration, random float64) time.Duration {
+	return time.Duration(float64(interval) * (1 + reapJitter*(2*random-1)))
+}
+
+// ReapLocks deletes the lock objects which expired more than
+// Config.LockReapMargin ago, according to the clock of the OSS server, e.g.
+// because their holder crashed, or which were released more than
+// LockReapMargin ago, and the claims on lock objects left behind by
+// takeovers (see transitionLock). It returns the number of objects deleted.
+// Failures to delete an object do not stop the pass and are returned
+// together.
+func (s *Storage) ReapLocks(ctx context.Context) (int, error) {
+	objects, err := s.listLockObjects(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		deleted int
+		errs    []error
+	)
+	for _, object := range objects {
+		var reaped bool
+		if key, ok := s.lockName(object); ok {
+			reaped, err = s.reapLock(ctx, key, object)
+		} else if lockKey, etag, ok := parseLockClaimName(object); ok {
+			reaped, err = s.reapClaim(ctx, object, lockKey, etag)
+		} else {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if reaped {
+			deleted++
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return deleted, errors.Join(errs...)
+}
+
+// reapMargin returns the duration after their expiry or release after which
+// lock objects are deleted by the reaper.
+func (s *Storage) reapMargin() time.Duration {
+	if s.lockReapMargin > 0 {
+		return s.lockReapMargin
+	}
+	return s.lockExpiration
+}
+
+// stale reports whether the lock object read in state expired, or was
+// released, more than the margin of the reaper ago.
+func (s *Storage) stale(state lockState, expiration time.Duration) bool {
+	since := state.expiresAt(expiration)
+	if state.record.Released {
+		since = state.lastModified
+	}
+	return !state.serverTime.Before(since.Add(s.reapMargin()))
+}
+
+// reapLock deletes the lock object lockKey of the lock on key if it is
+// stale. By then, the time of the server in milliseconds, which the next
+// acquisition gets as its fencing token, exceeds the fencing token of the
+// lock object (see nextFence).
+func (s *Storage) reapLock(ctx context.Context, key, lockKey string) (bool, error) {
+	state, err := s.readLock(ctx, lockKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil || !s.stale(state, s.lockExpiration) {
+		return false, err
+	}
+
+	// Delete the lock object, unless it is being taken over
+	err = s.transitionLock(ctx, lockKey, state, func(current lockState) error {
+		if !s.stale(current, s.lockExpiration) {
+			return errLockChanged
+		}
+		return nil
+	}, func(ctx context.Context) error {
+		return s.deleteLock(ctx, lockKey)
+	})
+	if errors.Is(err, errLockChanged) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("reaping lock %s: %w", lockKey, err)
+	}
+	s.logger.Info("reaped stale lock",
+		zap.String("key", key),
+		zap.String("owner", state.record.Owner),
+		zap.Time("expires_at", state.expiresAt(s.lockExpiration)))
+	return true, nil
+}
+
+// reapClaim deletes the claim claimKey on the version etag of the lock
+// object lockKey if it is stale and the lock object changed since: a claim
+// on the current version of the lock object must be kept, for its claimant
+// to find out it was overtaken if it resumes.
+func (s *Storage) reapClaim(ctx context.Context, claimKey, lockKey, etag string) (bool, error) {
+	claim, err := s.readLock(ctx, claimKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil || !s.stale(claim, lockClaimExpiration) {
+		return false, err
+	}
+
+	lock, err := s.readLock(ctx, lockKey)
+	if err == nil && strings.Trim(lock.etag, `"`) == etag {
+		return false, nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+
+	if err := s.deleteLock(ctx, claimKey); err != nil {
+		return false, err
+	}
+	return true, nil
+}
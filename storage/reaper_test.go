@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeLockExpiringAt writes a lock on key held by owner, expiring at
+// expiresAt, and returns it as read back.
+func writeLockExpiringAt(t *testing.T, s *Storage, key, owner string, expiresAt time.Time) lockState {
+	t.Helper()
+	ctx := context.Background()
+	record, err := s.newLockRecord()
+	require.NoError(t, err)
+	record.Owner = owner
+	record.ExpiresAt = expiresAt
+	require.NoError(t, s.writeLock(ctx, s.objLockName(key), record, false))
+	state, err := s.readLock(ctx, s.objLockName(key))
+	require.NoError(t, err)
+	return state
+}
+
+func TestReapLocks(t *testing.T) {
+	local := newFakeClock()
+	a, b := setupSkewedStorages(t, local, time.Hour)
+	a.lockReapMargin = 30 * time.Second
+	ctx := context.Background()
+	a.syncClock(ctx, "sync")
+	b.syncClock(ctx, "sync")
+	start := a.clock.now()
+
+	// Left behind by a crashed instance.
+	writeLockExpiringAt(t, b, "crashed.com", "crashed", start.Add(-time.Minute))
+	// A claim on a version of the lock which was replaced since.
+	moved := writeLockExpiringAt(t, b, "moved.com", "b", start.Add(time.Hour))
+	_, err := b.claimLock(ctx, b.objLockName("moved.com"), moved.etag)
+	require.NoError(t, err)
+	moved = writeLockExpiringAt(t, b, "moved.com", "b", start.Add(time.Hour))
+	// A claim on the current version of the lock, whose claimant may resume.
+	current := writeLockExpiringAt(t, b, "current.com", "b", start.Add(time.Hour))
+	_, err = b.claimLock(ctx, b.objLockName("current.com"), current.etag)
+	require.NoError(t, err)
+
+	local.Add(2 * time.Minute)
+	require.NoError(t, b.Lock(ctx, "held.com"))
+	writeLockExpiringAt(t, b, "recent.com", "b", b.clock.now().Add(-10*time.Second))
+
+	deleted, err := a.ReapLocks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+
+	assert.False(t, lockHeld(t, a, a.objLockName("crashed.com")), "stale lock")
+	assert.False(t, a.Exists(ctx, lockClaimName(a.objLockName("moved.com"), moved.etag, 1)), "stale claim")
+	assert.True(t, a.Exists(ctx, a.objLockName("moved.com")))
+	assert.True(t, a.Exists(ctx, a.objLockName("current.com")))
+	assert.True(t, a.Exists(ctx, lockClaimName(a.objLockName("current.com"), current.etag, 1)),
+		"claim on the current version of the lock")
+	assert.True(t, a.Exists(ctx, a.objLockName("held.com")))
+	assert.True(t, a.Exists(ctx, a.objLockName("recent.com")), "expired within the margin")
+
+	// Nothing left to reap.
+	deleted, err = a.ReapLocks(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+}
+
+func TestReapLocks_DefaultMargin(t *testing.T) {
+	local := newFakeClock()
+	s, _ := setupSkewedStorages(t, local, 0)
+	ctx := context.Background()
+	require.NoError(t, s.Lock(ctx, "example.com"))
+
+	// Expired, but not for a whole lock expiration.
+	local.Add(s.lockExpiration + 30*time.Second)
+	deleted, err := s.ReapLocks(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+
+	local.Add(s.lockExpiration)
+	deleted, err = s.ReapLocks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+}
+
+func TestReapLocks_Released(t *testing.T) {
+	local := newFakeClock()
+	s, _ := setupSkewedStorages(t, local, 0)
+	s.lockPrefix = "locks/"
+	ctx := context.Background()
+	require.NoError(t, s.Lock(ctx, "example.com"))
+	fence, _ := s.FencingToken("example.com")
+	require.NoError(t, s.Unlock(ctx, "example.com"))
+	assert.True(t, s.Exists(ctx, s.objLockName("example.com")), "kept for the fencing token")
+
+	deleted, err := s.ReapLocks(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+
+	local.Add(s.lockExpiration)
+	deleted, err = s.ReapLocks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.False(t, s.Exists(ctx, s.objLockName("example.com")))
+
+	require.NoError(t, s.Lock(ctx, "example.com"))
+	next, _ := s.FencingToken("example.com")
+	assert.Greater(t, next, fence)
+	require.NoError(t, s.Unlock(ctx, "example.com"))
+}
+
+func TestReapDelay(t *testing.T) {
+	assert.Equal(t, 80*time.Second, reapDelay(100*time.Second, 0))
+	assert.Equal(t, 100*time.Second, reapDelay(100*time.Second, 0.5))
+	assert.InDelta(t, float64(120*time.Second), float64(reapDelay(100*time.Second, 0.9999)), float64(time.Second))
+}
+
+func TestRunReaper(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	s.lockReapInterval = 20 * time.Millisecond
+	s.lockReapMargin = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.RunReaper(ctx)
+	}()
+
+	writeExpiredLock(t, s, "example.com")
+	assert.Eventually(t, func() bool {
+		_, err := s.InspectLock(context.Background(), "example.com")
+		return errors.Is(err, fs.ErrNotExist)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reaper did not stop")
+	}
+}
+
+func TestRunReaper_Disabled(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.RunReaper(context.Background())
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("disabled reaper did not return")
+	}
+}
+
+func TestParseLockClaimName(t *testing.T) {
+	lockKey, etag, ok := parseLockClaimName(lockClaimName("certs/example.com.lock", `"ABCDEF"`, 12))
+	require.True(t, ok)
+	assert.Equal(t, "certs/example.com.lock", lockKey)
+	assert.Equal(t, "ABCDEF", etag)
+
+	for _, key := range []string{
+		"certs/example.com.lock",
+		"certs/example.com.lock.claim-ABCDEF",
+		"certs/example.com.lock.claim-ABCDEF-x",
+		"certs/example.com.crt",
+	} {
+		_, _, ok := parseLockClaimName(key)
+		assert.False(t, ok, key)
+	}
+}
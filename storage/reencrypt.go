@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+)
+
+// ReEncryptOptions configures ReEncrypt.
+type ReEncryptOptions struct {
+	// StartAfter resumes an interrupted run: only keys sorting after it are
+	// processed. Use the LastKey of the progress reported by the previous run.
+	StartAfter string
+	// DryRun loads and decrypts every object without writing it back.
+	DryRun bool
+	// Progress, if set, is called after each object is processed.
+	Progress func(ReEncryptProgress)
+}
+
+// ReEncryptProgress reports the progress of ReEncrypt.
+type ReEncryptProgress struct {
+	// LastKey is the last key that was processed successfully.
+	LastKey string
+	// Processed is the number of objects processed so far in this run.
+	Processed int
+	// Total is the number of objects to process in this run.
+	Total int
+}
+
+// ReEncrypt rewrites every object of the bucket so that it is encrypted
+// under the current primary key, e.g. after rotating the keyset, allowing
+// the old keys to be disabled afterwards. Each object is loaded and stored
+// again while holding its lock. Lock objects are skipped.
+//
+// Objects are processed in lexicographic order. If ReEncrypt fails, the
+// returned progress tells which key to resume after with
+// ReEncryptOptions.StartAfter.
+func (s *Storage) ReEncrypt(ctx context.Context, opts ReEncryptOptions) (ReEncryptProgress, error) {
+	var progress ReEncryptProgress
+
+	keys, err := s.List(ctx, "", true)
+	if err != nil {
+		return progress, err
+	}
+	sort.Strings(keys)
+
+	var todo []string
+	for _, key := range keys {
+		if isLockObject(key) || key <= opts.StartAfter {
+			continue
+		}
+		todo = append(todo, key)
+	}
+	progress.LastKey = opts.StartAfter
+	progress.Total = len(todo)
+
+	for _, key := range todo {
+		if err := s.reEncryptObject(ctx, key, opts.DryRun); err != nil {
+			return progress, err
+		}
+		progress.LastKey = key
+		progress.Processed++
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+	return progress, nil
+}
+
+// reEncryptObject loads key and stores it again under its lock.
+func (s *Storage) reEncryptObject(ctx context.Context, key string, dryRun bool) error {
+	if err := s.Lock(ctx, key); err != nil {
+		return fmt.Errorf("locking %s: %w", key, err)
+	}
+	defer func() {
+		_ = s.Unlock(ctx, key)
+	}()
+
+	value, err := s.Load(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		// deleted since it was listed
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+	return s.Store(ctx, key, value)
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rotatingKeyset is a keyset which can be rotated and have its old keys
+// disabled, like `tinkey rotate-keyset` and `tinkey disable-key` would.
+type rotatingKeyset struct {
+	t       *testing.T
+	manager *keyset.Manager
+	keyIDs  []uint32
+}
+
+func newRotatingKeyset(t *testing.T) *rotatingKeyset {
+	k := &rotatingKeyset{t: t, manager: keyset.NewManager()}
+	k.rotate()
+	return k
+}
+
+func (k *rotatingKeyset) rotate() {
+	keyID, err := k.manager.Add(aead.AES256GCMKeyTemplate())
+	require.NoError(k.t, err)
+	require.NoError(k.t, k.manager.SetPrimary(keyID))
+	k.keyIDs = append(k.keyIDs, keyID)
+}
+
+func (k *rotatingKeyset) disableOldKeys() {
+	for _, keyID := range k.keyIDs[:len(k.keyIDs)-1] {
+		require.NoError(k.t, k.manager.Disable(keyID))
+	}
+}
+
+func (k *rotatingKeyset) aead() tink.AEAD {
+	kh, err := k.manager.Handle()
+	require.NoError(k.t, err)
+	kp, err := aead.New(kh)
+	require.NoError(k.t, err)
+	return kp
+}
+
+func storeTestObjects(t *testing.T, s *Storage, n int) []string {
+	t.Helper()
+	var keys []string
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("certificates/example%d.com/cert.pem", i)
+		require.NoError(t, s.Store(context.Background(), key, []byte(key)))
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestReEncrypt(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+	ks := newRotatingKeyset(t)
+	s.aead = ks.aead()
+	keys := storeTestObjects(t, s, 5)
+
+	ks.rotate()
+	s.aead = ks.aead()
+
+	var reported []ReEncryptProgress
+	progress, err := s.ReEncrypt(ctx, ReEncryptOptions{
+		Progress: func(p ReEncryptProgress) { reported = append(reported, p) },
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 5, progress.Total)
+	assert.Equal(t, 5, progress.Processed)
+	assert.Equal(t, keys[4], progress.LastKey)
+	require.Len(t, reported, 5)
+	assert.Equal(t, keys[0], reported[0].LastKey)
+
+	// Every object is readable with the old key disabled.
+	ks.disableOldKeys()
+	s.aead = ks.aead()
+	for _, key := range keys {
+		loaded, err := s.Load(ctx, key)
+		require.NoError(t, err, key)
+		assert.Equal(t, []byte(key), loaded)
+	}
+
+	// All locks were released.
+	for _, key := range keys {
+		assert.False(t, lockHeld(t, s, s.objLockName(key)))
+	}
+}
+
+func TestReEncrypt_DryRun(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+	ks := newRotatingKeyset(t)
+	s.aead = ks.aead()
+	keys := storeTestObjects(t, s, 3)
+
+	ks.rotate()
+	s.aead = ks.aead()
+	progress, err := s.ReEncrypt(ctx, ReEncryptOptions{DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, 3, progress.Processed)
+
+	// Nothing was rewritten: the objects still need the old key.
+	ks.disableOldKeys()
+	s.aead = ks.aead()
+	_, err = s.Load(ctx, keys[0])
+	assert.Error(t, err)
+}
+
+func TestReEncrypt_Resume(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+	ks := newRotatingKeyset(t)
+	s.aead = ks.aead()
+	keys := storeTestObjects(t, s, 4)
+
+	ks.rotate()
+	s.aead = ks.aead()
+	progress, err := s.ReEncrypt(ctx, ReEncryptOptions{StartAfter: keys[1]})
+	require.NoError(t, err)
+	assert.Equal(t, 2, progress.Total)
+	assert.Equal(t, keys[3], progress.LastKey)
+
+	ks.disableOldKeys()
+	s.aead = ks.aead()
+	_, err = s.Load(ctx, keys[1])
+	assert.Error(t, err, "keys up to StartAfter are skipped")
+	_, err = s.Load(ctx, keys[2])
+	assert.NoError(t, err)
+}
+
+func TestReEncrypt_StopsOnUndecryptableObject(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+	keys := storeTestObjects(t, s, 3)
+
+	// The objects are cleartext, so decrypting the first one fails and the
+	// run stops before anything was processed.
+	ks := newRotatingKeyset(t)
+	s.aead = ks.aead()
+	progress, err := s.ReEncrypt(ctx, ReEncryptOptions{})
+	assert.Error(t, err)
+	assert.Equal(t, 0, progress.Processed)
+	assert.Equal(t, "", progress.LastKey)
+	assert.False(t, lockHeld(t, s, s.objLockName(keys[0])))
+}
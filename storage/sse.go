@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"go.uber.org/zap"
+)
+
+// Server-side encryption algorithms supported by Config.ServerSideEncryption.
+const (
+	// ServerSideEncryptionAES256 encrypts objects with keys managed by OSS
+	// (SSE-OSS).
+	ServerSideEncryptionAES256 = "AES256"
+	// ServerSideEncryptionKMS encrypts objects with a KMS key (SSE-KMS).
+	ServerSideEncryptionKMS = "KMS"
+)
+
+// validateServerSideEncryption checks the server-side encryption settings of
+// config.
+func validateServerSideEncryption(config Config) error {
+	switch config.ServerSideEncryption {
+	case "", ServerSideEncryptionAES256:
+		if config.ServerSideEncryptionKeyID != "" {
+			return errors.New("ServerSideEncryptionKeyID requires KMS server-side encryption")
+		}
+	case ServerSideEncryptionKMS:
+	default:
+		return fmt.Errorf("unknown server-side encryption %q (want %s or %s)",
+			config.ServerSideEncryption, ServerSideEncryptionAES256, ServerSideEncryptionKMS)
+	}
+	return nil
+}
+
+// withSSE sets the configured server-side encryption headers on req.
+func (s *Storage) withSSE(req *oss.PutObjectRequest) *oss.PutObjectRequest {
+	if s.sse != "" {
+		req.ServerSideEncryption = oss.Ptr(s.sse)
+	}
+	if s.sseKeyID != "" {
+		req.ServerSideEncryptionKeyId = oss.Ptr(s.sseKeyID)
+	}
+	return req
+}
+
+// BucketDefaultEncryption returns the default server-side encryption
+// algorithm of the bucket, or "" if the bucket has none.
+func (s *Storage) BucketDefaultEncryption(ctx context.Context) (string, error) {
+	result, err := s.client.GetBucketEncryption(ctx, &oss.GetBucketEncryptionRequest{
+		Bucket: oss.Ptr(s.bucketName),
+	})
+	if err != nil {
+		var serviceErr *oss.ServiceError
+		if errors.As(err, &serviceErr) && serviceErr.ErrorCode() == "NoSuchServerSideEncryptionRule" {
+			return "", nil
+		}
+		return "", fmt.Errorf("getting encryption of bucket %s: %w", s.bucketName, err)
+	}
+	rule := result.ServerSideEncryptionRule
+	if rule == nil || rule.ApplyServerSideEncryptionByDefault == nil {
+		return "", nil
+	}
+	return oss.ToString(rule.ApplyServerSideEncryptionByDefault.SSEAlgorithm), nil
+}
+
+// CheckBucketEncryption logs a warning when the bucket has no default
+// server-side encryption, or when it cannot be checked. It is meant to be
+// called once at startup.
+func (s *Storage) CheckBucketEncryption(ctx context.Context) {
+	algorithm, err := s.BucketDefaultEncryption(ctx)
+	if err != nil {
+		s.logger.Warn("could not check the default encryption of the bucket", zap.Error(err))
+		return
+	}
+	if algorithm == "" {
+		s.logger.Warn("bucket has no default server-side encryption",
+			zap.String("bucket", s.bucketName),
+			zap.String("server_side_encryption", s.sse))
+		return
+	}
+	s.logger.Debug("bucket default server-side encryption",
+		zap.String("bucket", s.bucketName),
+		zap.String("algorithm", algorithm))
+}
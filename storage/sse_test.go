@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestServerSideEncryption_StoreAndLock(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+	s.sse = ServerSideEncryptionKMS
+	s.sseKeyID = "kms-key-id"
+
+	require.NoError(t, s.Store(ctx, "cert.pem", []byte("value")))
+	require.NoError(t, s.Lock(ctx, "cert.pem"))
+	defer s.Unlock(ctx, "cert.pem")
+
+	for _, key := range []string{"cert.pem", s.objLockName("cert.pem")} {
+		head, err := s.client.HeadObject(ctx, &oss.HeadObjectRequest{
+			Bucket: oss.Ptr(s.bucketName),
+			Key:    oss.Ptr(key),
+		})
+		require.NoError(t, err)
+		assert.Equal(t, ServerSideEncryptionKMS, oss.ToString(head.ServerSideEncryption), key)
+		assert.Equal(t, "kms-key-id", oss.ToString(head.ServerSideEncryptionKeyId), key)
+	}
+}
+
+func TestServerSideEncryption_NotRequested(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+
+	require.NoError(t, s.Store(ctx, "cert.pem", []byte("value")))
+	head, err := s.client.HeadObject(ctx, &oss.HeadObjectRequest{
+		Bucket: oss.Ptr(s.bucketName),
+		Key:    oss.Ptr("cert.pem"),
+	})
+	require.NoError(t, err)
+	assert.Nil(t, head.ServerSideEncryption)
+}
+
+func TestNewStorage_ServerSideEncryptionValidation(t *testing.T) {
+	tests := map[string]struct {
+		sse     string
+		keyID   string
+		wantErr bool
+	}{
+		"none":             {"", "", false},
+		"AES256":           {ServerSideEncryptionAES256, "", false},
+		"KMS":              {ServerSideEncryptionKMS, "", false},
+		"KMS with key":     {ServerSideEncryptionKMS, "key-id", false},
+		"AES256 with key":  {ServerSideEncryptionAES256, "key-id", true},
+		"key without SSE":  {"", "key-id", true},
+		"unknown":          {"SM4", "", true},
+		"wrong case (kms)": {"kms", "", true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewStorage(context.Background(), Config{
+				AccessKeyID:               "test-ak",
+				AccessKeySecret:           "test-sk",
+				ServerSideEncryption:      tt.sse,
+				ServerSideEncryptionKeyID: tt.keyID,
+			})
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestCheckBucketEncryption(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+	core, logs := observer.New(zap.DebugLevel)
+	s.logger = zap.New(core)
+
+	algorithm, err := s.BucketDefaultEncryption(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "", algorithm)
+	s.CheckBucketEncryption(ctx)
+	require.Equal(t, 1, logs.FilterLevelExact(zapcore.WarnLevel).Len())
+	assert.Equal(t, "bucket has no default server-side encryption", logs.All()[0].Message)
+
+	_, err = s.client.PutBucketEncryption(ctx, &oss.PutBucketEncryptionRequest{
+		Bucket: oss.Ptr(s.bucketName),
+		ServerSideEncryptionRule: &oss.ServerSideEncryptionRule{
+			ApplyServerSideEncryptionByDefault: &oss.ApplyServerSideEncryptionByDefault{
+				SSEAlgorithm: oss.Ptr(ServerSideEncryptionAES256),
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	algorithm, err = s.BucketDefaultEncryption(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, ServerSideEncryptionAES256, algorithm)
+	s.CheckBucketEncryption(ctx)
+	assert.Equal(t, 1, logs.FilterLevelExact(zapcore.WarnLevel).Len(), "no new warning")
+}
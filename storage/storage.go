@@ -7,19 +7,29 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
 	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss/credentials"
 	"github.com/caddyserver/certmagic"
 	"github.com/google/tink/go/tink"
+	"go.uber.org/zap"
 )
 
 var (
 	// DefaultLockExpiration is the default duration before which a Lock is considered expired.
 	DefaultLockExpiration = 5 * time.Minute
-	// LockPollInterval is the interval between each check of the lock state.
+	// LockPollInterval is the default initial interval between each check of
+	// the lock state.
+	//
+	// Deprecated: set Config.LockPollInterval, which can differ between two
+	// Storage instances, instead. LockPollInterval is only used when it is
+	// zero.
 	LockPollInterval = 1 * time.Second
 )
 
@@ -27,8 +37,32 @@ var (
 type Storage struct {
 	client         *oss.Client
 	bucketName     string
+	prefix         string
 	aead           tink.AEAD
 	lockExpiration time.Duration
+	logger         *zap.Logger
+
+	migrateCleartext        bool
+	rewriteCleartextObjects bool
+
+	rejectStaleWrites bool
+
+	sse      string
+	sseKeyID string
+
+	instanceID string
+	locksMu    sync.Mutex
+	locks      map[string]*lockLease // locks held, by key
+	queues     map[string]*lockQueue // goroutines locking, by key
+
+	lockPrefix        string
+	legacyLocks       bool
+	lockRenewInterval time.Duration
+	lockBackoff       lockBackoff
+	lockReapInterval  time.Duration
+	lockReapMargin    time.Duration
+	clock             serverClock
+	lastFence         atomic.Uint64 // last fencing token issued
 }
 
 // Interface guards
@@ -40,8 +74,34 @@ var (
 type Config struct {
 	// AEAD for Authenticated Encryption with Additional Data
 	AEAD tink.AEAD
+	// KEK enables envelope encryption: each object is encrypted with its own
+	// data key, which is stored alongside the ciphertext wrapped by KEK.
+	// Mutually exclusive with AEAD.
+	KEK KEK
+	// MigrateCleartext allows Load to return objects stored in cleartext
+	// when AEAD or KEK is set, e.g. objects written before encryption was
+	// enabled. Otherwise loading them fails.
+	MigrateCleartext bool
+	// RewriteCleartext makes Load store such cleartext objects again,
+	// encrypted. Requires MigrateCleartext.
+	RewriteCleartext bool
+	// ServerSideEncryption, if set, makes OSS encrypt every object written
+	// at rest: ServerSideEncryptionAES256 (SSE-OSS) or
+	// ServerSideEncryptionKMS (SSE-KMS). It is independent of the client
+	// side encryption configured by AEAD or KEK.
+	ServerSideEncryption string
+	// ServerSideEncryptionKeyID is the KMS key used by SSE-KMS. Defaults to
+	// the key managed by OSS.
+	ServerSideEncryptionKeyID string
 	// BucketName is the name of the OSS storage Bucket
 	BucketName string
+	// Prefix is prepended to every key, so that several deployments (e.g.
+	// staging and production, or tenants) can share a bucket. It is
+	// followed by a slash if it does not end with one, and stripped from
+	// the keys returned by List. Locks are scoped by Prefix too. Objects are
+	// encrypted with their key without Prefix as associated data, so they
+	// can be moved to another prefix.
+	Prefix string
 	// Region is the OSS region
 	Region string
 	// Endpoint is the OSS endpoint
@@ -50,14 +110,96 @@ type Config struct {
 	AccessKeyID string
 	// AccessKeySecret is the access key secret for OSS
 	AccessKeySecret string
+	// SecurityToken is the STS security token to use along with
+	// AccessKeyID and AccessKeySecret when they are temporary credentials
+	SecurityToken string
+	// CredentialsProvider supplies the credentials for OSS. If set, it
+	// takes precedence over AccessKeyID, AccessKeySecret and SecurityToken.
+	// Use a RefreshingCredentialsProvider to rotate short-lived STS
+	// credentials without recreating the Storage. If nil, the credentials
+	// are resolved from the OSS_ACCESS_KEY_ID, OSS_ACCESS_KEY_SECRET and
+	// OSS_SESSION_TOKEN environment variables, then the Alibaba Cloud CLI
+	// configuration file, then the static keys above.
+	CredentialsProvider credentials.CredentialsProvider
+	// CredentialsFile is the Alibaba Cloud CLI configuration file to read
+	// credentials from. Defaults to ~/.alibabacloud/config.json.
+	CredentialsFile string
+	// Profile is the profile of CredentialsFile to use. Defaults to the
+	// ALIBABA_CLOUD_PROFILE environment variable, then the current profile.
+	Profile string
+	// Logger is used to report notable events. Defaults to a no-op logger.
+	Logger *zap.Logger
 	// LockExpiration is the duration before a lock is considered expired.
 	// Defaults to DefaultLockExpiration (5 minutes) if zero.
 	LockExpiration time.Duration
+	// LockRenewInterval is the interval at which the leases of the locks
+	// held are renewed. Defaults to a third of LockExpiration if zero;
+	// negative disables the renewal.
+	LockRenewInterval time.Duration
+	// InstanceID identifies this instance as the owner of the locks it
+	// holds. Defaults to the hostname and process ID.
+	InstanceID string
+	// LockPollInterval is the initial interval between two checks of a lock
+	// held by another holder. Defaults to the LockPollInterval variable
+	// (1 second) if zero.
+	LockPollInterval time.Duration
+	// LockPollMaxInterval is the maximum interval between two checks of a
+	// lock. Defaults to DefaultLockPollMaxInterval (10 seconds) if zero.
+	LockPollMaxInterval time.Duration
+	// LockPollMultiplier is the factor by which the interval between two
+	// checks of a lock grows, at least 1. Defaults to
+	// DefaultLockPollMultiplier (2) if zero.
+	LockPollMultiplier float64
+	// LockPollJitter is the fraction, at most 1, by which the intervals
+	// between two checks of a lock are randomly shortened or lengthened, so
+	// that the instances waiting for a lock do not check it in lockstep.
+	// Defaults to DefaultLockPollJitter (0.2) if zero; negative disables the
+	// jitter.
+	LockPollJitter float64
+	// LockMaxWait is the maximum duration Lock waits for a lock held by
+	// another holder before failing with ErrLockWaitTimeout. If zero, Lock
+	// waits until its context is done.
+	LockMaxWait time.Duration
+	// LockReapInterval is the interval between two passes of RunReaper,
+	// which deletes the lock objects left behind by crashed instances, and
+	// those kept under LockPrefix once released. Zero disables the reaper.
+	LockReapInterval time.Duration
+	// LockReapMargin is the duration after their expiry or release after
+	// which lock objects are deleted by the reaper. Defaults to
+	// LockExpiration if zero.
+	LockReapMargin time.Duration
+	// LockPrefix is the prefix of the lock objects within Prefix, e.g.
+	// "locks/", so that they are kept apart from the data and can have their
+	// own lifecycle rules. The key is escaped, so that every lock object is
+	// a direct child of the prefix. If empty, the lock object of a key is
+	// stored next to it, with the ".lock" suffix.
+	LockPrefix string
+	// LegacyLocks makes locks also hold the lock objects stored next to
+	// their key, as older versions and instances without LockPrefix do, so
+	// that LockPrefix can be enabled with a rolling upgrade. It can be
+	// disabled once no instance uses the former location. Requires
+	// LockPrefix.
+	LegacyLocks bool
+	// RejectStaleWrites makes Store fail with ErrStaleFencingToken when the
+	// object was written with a newer fencing token than the one carried by
+	// the context of the write (see WithFencingToken). Writes whose context
+	// carries no fencing token, like those of CertMagic, are not checked, so
+	// this is only useful to library users.
+	RejectStaleWrites bool
 }
 
 func NewStorage(ctx context.Context, config Config) (*Storage, error) {
+	logger := config.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
 	// Create credentials provider
-	creds := credentials.NewStaticCredentialsProvider(config.AccessKeyID, config.AccessKeySecret, "")
+	creds, fields, err := resolveCredentials(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("using OSS credentials", fields...)
 	
 	// Create config
 	cfg := oss.LoadDefaultConfig().
@@ -78,33 +220,104 @@ func NewStorage(ctx context.Context, config Config) (*Storage, error) {
 	client := oss.NewClient(cfg)
 	
 	var kp tink.AEAD
-	if config.AEAD != nil {
+	switch {
+	case config.AEAD != nil && config.KEK != nil:
+		return nil, errors.New("AEAD and KEK are mutually exclusive")
+	case config.KEK != nil:
+		kp = &envelopeAEAD{kek: config.KEK}
+	case config.AEAD != nil:
 		kp = config.AEAD
-	} else {
+	default:
 		kp = new(cleartext)
 	}
 	
+	if config.RewriteCleartext && !config.MigrateCleartext {
+		return nil, errors.New("RewriteCleartext requires MigrateCleartext")
+	}
+	if err := validateServerSideEncryption(config); err != nil {
+		return nil, err
+	}
+	if err := validateLockBackoff(config); err != nil {
+		return nil, err
+	}
+	if err := validateLockPrefix(config); err != nil {
+		return nil, err
+	}
+	prefix := config.Prefix
+	if strings.HasPrefix(prefix, "/") {
+		return nil, errors.New("Prefix must not start with /")
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	
 	lockExp := config.LockExpiration
 	if lockExp == 0 {
 		lockExp = DefaultLockExpiration
 	}
+	instanceID := config.InstanceID
+	if instanceID == "" {
+		instanceID = defaultInstanceID()
+	}
 
-	return &Storage{client: client, bucketName: config.BucketName, aead: kp, lockExpiration: lockExp}, nil
+	return &Storage{
+		client:                  client,
+		bucketName:              config.BucketName,
+		prefix:                  prefix,
+		aead:                    kp,
+		lockExpiration:          lockExp,
+		logger:                  logger,
+		migrateCleartext:        config.MigrateCleartext,
+		rewriteCleartextObjects: config.RewriteCleartext,
+		rejectStaleWrites:       config.RejectStaleWrites,
+		sse:                     config.ServerSideEncryption,
+		sseKeyID:                config.ServerSideEncryptionKeyID,
+		instanceID:              instanceID,
+		lockPrefix:              config.LockPrefix,
+		legacyLocks:             config.LegacyLocks,
+		lockRenewInterval:       config.LockRenewInterval,
+		lockReapInterval:        config.LockReapInterval,
+		lockReapMargin:          config.LockReapMargin,
+		lockBackoff: lockBackoff{
+			initial:    config.LockPollInterval,
+			max:        config.LockPollMaxInterval,
+			multiplier: config.LockPollMultiplier,
+			jitter:     config.LockPollJitter,
+			maxWait:    config.LockMaxWait,
+		},
+	}, nil
 }
 
 // Store puts value at key.
+//
+// If ctx carries a fencing token (see WithFencingToken), it is recorded in
+// the metadata of the object and, with RejectStaleWrites, the write fails
+// with ErrStaleFencingToken if the object was written with a newer one.
 func (s *Storage) Store(ctx context.Context, key string, value []byte) error {
+	metadata := map[string]string{
+		metaEncryption: s.encryptionScheme(),
+	}
+	if token, ok := FencingTokenFromContext(ctx); ok {
+		if s.rejectStaleWrites {
+			if err := s.checkFence(ctx, key, token); err != nil {
+				return err
+			}
+		}
+		metadata[metaFence] = strconv.FormatUint(token, 10)
+	}
+
 	encrypted, err := s.aead.Encrypt(value, []byte(key))
 	if err != nil {
 		return fmt.Errorf("encrypting object %s: %w", key, err)
 	}
 	
 	// Use the PutObject API
-	_, err = s.client.PutObject(ctx, &oss.PutObjectRequest{
-		Bucket: oss.Ptr(s.bucketName),
-		Key:    oss.Ptr(key),
-		Body:   bytes.NewReader(encrypted),
-	})
+	_, err = s.client.PutObject(ctx, s.withSSE(&oss.PutObjectRequest{
+		Bucket:   oss.Ptr(s.bucketName),
+		Key:      oss.Ptr(s.objName(key)),
+		Body:     bytes.NewReader(encrypted),
+		Metadata: metadata,
+	}))
 	
 	if err != nil {
 		return fmt.Errorf("writing object %s: %w", key, err)
@@ -116,7 +329,7 @@ func (s *Storage) Store(ctx context.Context, key string, value []byte) error {
 func (s *Storage) Load(ctx context.Context, key string) ([]byte, error) {
 	result, err := s.client.GetObject(ctx, &oss.GetObjectRequest{
 		Bucket: oss.Ptr(s.bucketName),
-		Key:    oss.Ptr(key),
+		Key:    oss.Ptr(s.objName(key)),
 	})
 	
 	if err != nil {
@@ -132,40 +345,96 @@ func (s *Storage) Load(ctx context.Context, key string) ([]byte, error) {
 		return nil, fmt.Errorf("reading object %s: %w", key, err)
 	}
 
-	decrypted, err := s.aead.Decrypt(encrypted, []byte(key))
+	decrypted, legacy, err := s.decrypt(key, encrypted, result.Metadata[metaEncryption])
 	if err != nil {
 		return nil, fmt.Errorf("decrypting object %s: %w", key, err)
 	}
+	if legacy && s.rewriteCleartextObjects {
+		s.rewriteCleartext(ctx, key, decrypted, oss.ToString(result.ETag))
+	}
 	return decrypted, nil
 }
 
 // Delete deletes key. An error should be
 // returned only if the key still exists
 // when the method returns.
+//
+// Like certmagic.FileStorage, Delete also deletes the "directory" key, i.e.
+// every object beneath key, except the lock objects (see deletePrefix). A
+// key ending with a slash is only deleted as a directory. Deleting a key
+// therefore always costs a LIST request for key+"/" besides the
+// DeleteObject request, even if key is not a directory.
 func (s *Storage) Delete(ctx context.Context, key string) error {
+	if strings.HasSuffix(key, "/") {
+		return s.deletePrefix(ctx, key)
+	}
+	
 	_, err := s.client.DeleteObject(ctx, &oss.DeleteObjectRequest{
 		Bucket: oss.Ptr(s.bucketName),
-		Key:    oss.Ptr(key),
+		Key:    oss.Ptr(s.objName(key)),
 	})
 	
-	if err != nil {
-		if isNotFound(err) {
-			return nil
-		}
+	if err != nil && !isNotFound(err) {
 		return fmt.Errorf("deleting object %s: %w", key, err)
 	}
-	return nil
+	return s.deletePrefix(ctx, key+"/")
 }
 
+// existsAttempts is the number of times Exists checks a key before giving
+// up on errors, waiting existsRetryInterval, then twice as long, and so on,
+// between two attempts.
+var (
+	existsAttempts      = 3
+	existsRetryInterval = 500 * time.Millisecond
+)
+
 // Exists returns true if the key exists
 // and there was no error checking.
+//
+// Errors other than a missing key, e.g. a network failure or a denied
+// access, are logged and the check is retried: CertMagic takes a missing
+// key for a missing certificate, and may then obtain it again and hit the
+// rate limits of the ACME CA. If the key still cannot be checked, Exists
+// returns false. Use ExistsE to handle the errors.
 func (s *Storage) Exists(ctx context.Context, key string) bool {
+	wait := existsRetryInterval
+	for attempt := 1; ; attempt++ {
+		exists, err := s.ExistsE(ctx, key)
+		if err == nil {
+			return exists
+		}
+		if attempt == existsAttempts || ctx.Err() != nil {
+			s.logger.Error("checking existence, assuming the key does not exist",
+				zap.String("key", key), zap.Int("attempts", attempt), zap.Error(err))
+			return false
+		}
+		s.logger.Warn("checking existence, retrying",
+			zap.String("key", key), zap.Duration("retry_in", wait), zap.Error(err))
+		
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+		wait *= 2
+	}
+}
+
+// ExistsE reports whether the key exists. Unlike Exists, it returns the
+// errors other than a missing key instead of false, e.g. a network failure
+// or a denied access.
+func (s *Storage) ExistsE(ctx context.Context, key string) (bool, error) {
 	_, err := s.client.HeadObject(ctx, &oss.HeadObjectRequest{
 		Bucket: oss.Ptr(s.bucketName),
-		Key:    oss.Ptr(key),
+		Key:    oss.Ptr(s.objName(key)),
 	})
 	
-	return err == nil
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("checking existence of %s: %w", key, err)
+	}
+	return true, nil
 }
 
 // List returns all keys that match prefix.
@@ -173,16 +442,32 @@ func (s *Storage) Exists(ctx context.Context, key string) bool {
 // will be enumerated (i.e. "directories"
 // should be walked); otherwise, only keys
 // prefixed exactly by prefix will be listed.
+//
+// Like for certmagic.FileStorage, prefix is a "directory" in both modes: a
+// prefix without a trailing slash does not match the keys of its siblings
+// sharing its name as a prefix. Without recursive, List returns the keys of
+// its direct children, terminal or not, without a trailing slash, in
+// lexical order.
 func (s *Storage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return s.listPrefix(ctx, prefix, recursive)
+}
+
+// listPrefix returns the keys starting with prefix, taken as is rather than
+// as a "directory".
+func (s *Storage) listPrefix(ctx context.Context, prefix string, recursive bool) ([]string, error) {
 	var names []string
 	
 	// Set up options for listing objects
 	request := &oss.ListObjectsV2Request{
 		Bucket: oss.Ptr(s.bucketName),
-		Prefix: oss.Ptr(prefix),
+		Prefix: oss.Ptr(s.objName(prefix)),
 	}
 	
-	// If not recursive, we need to set delimiter to "/"
+	// If not recursive, list the children of the "directory" prefix: the
+	// objects within its sub-directories are grouped into common prefixes
 	if !recursive {
 		request.Delimiter = oss.Ptr("/")
 	}
@@ -199,25 +484,39 @@ func (s *Storage) List(ctx context.Context, prefix string, recursive bool) ([]st
 		
 		// Add object keys to result
 		for _, object := range page.Contents {
-			names = append(names, *object.Key)
+			names = append(names, strings.TrimPrefix(*object.Key, s.prefix))
+		}
+		for _, commonPrefix := range page.CommonPrefixes {
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(*commonPrefix.Prefix, s.prefix), "/"))
 		}
 	}
 	
+	if !recursive {
+		// Pages list their objects and common prefixes apart
+		sort.Strings(names)
+	}
 	return names, nil
 }
 
-// Stat returns information about key.
+// Stat returns information about key. If no object is named key, but
+// objects exist beneath it, key is a "directory": Stat then reports it as
+// non-terminal, with the total size and the latest modification of the
+// objects beneath it.
 func (s *Storage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
 	var keyInfo certmagic.KeyInfo
 	
+	if strings.HasSuffix(key, "/") {
+		return s.statPrefix(ctx, key)
+	}
+	
 	result, err := s.client.HeadObject(ctx, &oss.HeadObjectRequest{
 		Bucket: oss.Ptr(s.bucketName),
-		Key:    oss.Ptr(key),
+		Key:    oss.Ptr(s.objName(key)),
 	})
 	
 	if err != nil {
 		if isNotFound(err) {
-			return keyInfo, fs.ErrNotExist
+			return s.statPrefix(ctx, key)
 		}
 		return keyInfo, fmt.Errorf("loading attributes for %s: %w", key, err)
 	}
@@ -235,6 +534,40 @@ func (s *Storage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, erro
 	return keyInfo, nil
 }
 
+// statPrefix returns information about the "directory" key, summarised
+// from the objects beneath it, or fs.ErrNotExist if there are none.
+func (s *Storage) statPrefix(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	keyInfo := certmagic.KeyInfo{Key: key}
+	
+	prefix := key
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	p := s.client.NewListObjectsV2Paginator(&oss.ListObjectsV2Request{
+		Bucket: oss.Ptr(s.bucketName),
+		Prefix: oss.Ptr(s.objName(prefix)),
+	})
+	
+	var found bool
+	for p.HasNext() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return keyInfo, fmt.Errorf("loading attributes for %s: %w", key, err)
+		}
+		for _, object := range page.Contents {
+			found = true
+			keyInfo.Size += object.Size
+			if object.LastModified != nil && object.LastModified.After(keyInfo.Modified) {
+				keyInfo.Modified = *object.LastModified
+			}
+		}
+	}
+	if !found {
+		return keyInfo, fs.ErrNotExist
+	}
+	return keyInfo, nil
+}
+
 // Lock acquires the lock for key, blocking until the lock
 // can be obtained or an error is returned. Note that, even
 // after acquiring a lock, an idempotent operation may have
@@ -256,127 +589,283 @@ func (s *Storage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, erro
 // caller wishes to give up and free resources before the lock
 // can be obtained).
 //
-// IMPORTANT: TOCTOU race condition warning
+// Acquiring a free lock creates the lock object with ForbidOverwrite, so
+// only one contender succeeds. Taking over an expired lock overwrites the
+// lock object, which OSS cannot do conditionally: the takeover is therefore
+// guarded by a claim object created with ForbidOverwrite, so that only one
+// contender takes over a given version of the lock object (see
+// transitionLock). Renewals and releases of the lock go through the same
+// claims, so they cannot interleave with a takeover. With LockPrefix,
+// Unlock keeps the lock object, marked as released, so that the fencing
+// token of the next acquisition follows from its own: acquiring a lock
+// released before takes its lock object over like an expired one.
 //
-// When an expired lock is detected, this implementation performs a
-// delete-then-reacquire sequence (HeadObject to check expiration,
-// DeleteObject to remove the stale lock, then PutObject with
-// ForbidOverwrite to create a new lock). Because OSS does not support
-// atomic compare-and-swap (CAS) or conditional delete operations,
-// there is a time-of-check-to-time-of-use (TOCTOU) race window
-// between the delete and the subsequent put. In this window, another
-// process could also detect the expired lock, delete it, and
-// successfully acquire the lock — resulting in two processes believing
-// they hold the lock simultaneously.
-//
-// For single-instance Caddy deployments (the primary use case), this
-// is acceptable because lock contention is between goroutines within
-// the same process, and the ForbidOverwrite parameter provides
-// sufficient atomicity for the initial acquisition. However, this
-// implementation is NOT suitable for high-concurrency distributed
-// scenarios where multiple independent processes compete for the same
-// lock, as the TOCTOU window could lead to split-brain conditions.
+// While the lock is held by another holder, it is checked again at
+// exponentially growing, jittered intervals (see Config.LockPollInterval),
+// for at most Config.LockMaxWait. Goroutines of the same Storage locking
+// the same key wait for each other in the process, so that only one of them
+// at a time polls OSS.
 func (s *Storage) Lock(ctx context.Context, key string) error {
-	lockKey := s.objLockName(key)
+	_, err := s.LockContext(ctx, key)
+	return err
+}
+
+// LockContext acquires the lock for key like Lock. While the lock is held,
+// its lease is renewed in the background so that it does not expire during
+// long critical sections. The returned context carries the fencing token
+// of the lock (see FencingTokenFromContext) and is cancelled, with
+// ErrLockLost as its cause, if the lease could not be renewed before it
+// expired or the lock was taken over; the holder should then abort its
+// critical section. Unlock stops the renewal.
+func (s *Storage) LockContext(ctx context.Context, key string) (context.Context, error) {
+	start := s.clock.localNow()
 	
-	for {
-		// Try to create the lock object atomically using ForbidOverwrite header
-		// This will only succeed if the object doesn't already exist
-		_, err := s.client.PutObject(ctx, &oss.PutObjectRequest{
-			Bucket: oss.Ptr(s.bucketName),
-			Key:    oss.Ptr(lockKey),
-			Body:   bytes.NewReader([]byte{}),
-			ForbidOverwrite: oss.Ptr("true"), // This ensures the object is only created if it doesn't exist
-		})
-		
-		// If we successfully created the lock, return
-		if err == nil {
-			return nil
+	// Goroutines of this process locking the same key wait for each other
+	// here, so that only one of them polls OSS
+	var timeout <-chan time.Time
+	if maxWait := s.lockBackoff.maxWait; maxWait > 0 {
+		timer := time.NewTimer(maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	if err := s.enterLockQueue(ctx, key, timeout); err != nil {
+		if errors.Is(err, ErrLockWaitTimeout) {
+			err = fmt.Errorf("locking %s: %w after %s", key, err, s.lockBackoff.maxWait)
+		}
+		return nil, err
+	}
+	holderCtx, err := s.pollLock(ctx, key, start)
+	if err != nil {
+		s.leaveLockQueue(key)
+		return nil, err
+	}
+	return holderCtx, nil
+}
+
+// pollLock acquires the lock for key, checking it at growing intervals
+// while it is held by another holder, since start.
+func (s *Storage) pollLock(ctx context.Context, key string, start time.Time) (context.Context, error) {
+	s.syncClock(ctx, s.objLockName(key))
+	
+	for attempt := 0; ; attempt++ {
+		holderCtx, contended, err := s.acquireLock(ctx, key)
+		if holderCtx != nil {
+			return holderCtx, nil
+		}
+		if err != nil && !contended {
+			return nil, err
 		}
 		
-		// Check if the error is because the lock already exists
-		var serviceErr *oss.ServiceError
-		if errors.As(err, &serviceErr) && (serviceErr.ErrorCode() == "PreconditionFailed" || serviceErr.ErrorCode() == "ObjectAlreadyExists" || serviceErr.ErrorCode() == "FileAlreadyExists") {
-			// Lock already exists, check if it has expired
-			result, err := s.client.HeadObject(ctx, &oss.HeadObjectRequest{
-				Bucket: oss.Ptr(s.bucketName),
-				Key:    oss.Ptr(lockKey),
-			})
-			
-			if err != nil {
-				// If we can't check the lock, continue polling
-				select {
-				case <-time.After(LockPollInterval):
-					continue
-				case <-ctx.Done():
-					return ctx.Err()
-				}
+		// Lock exists and hasn't expired, or could not be checked: wait and try again
+		wait := s.lockBackoff.interval(attempt)
+		if maxWait := s.lockBackoff.maxWait; maxWait > 0 {
+			remaining := maxWait - s.clock.localNow().Sub(start)
+			if remaining <= 0 {
+				return nil, fmt.Errorf("locking %s: %w after %s", key, ErrLockWaitTimeout, maxWait)
 			}
-			
-			// Check if the lock has expired
-			if result.LastModified != nil && result.LastModified.Add(s.lockExpiration).Before(time.Now().UTC()) {
-				// Lock has expired, try to delete it and then acquire the lock
-				_, deleteErr := s.client.DeleteObject(ctx, &oss.DeleteObjectRequest{
-					Bucket: oss.Ptr(s.bucketName),
-					Key:    oss.Ptr(lockKey),
-				})
-				
-				// If we successfully deleted the expired lock or if it was already deleted, try to acquire the lock again
-				if deleteErr == nil || isNotFound(deleteErr) {
-					continue // Try to acquire the lock again
-				}
-				
-				// If we couldn't delete the expired lock, continue polling
-				select {
-				case <-time.After(LockPollInterval):
-					continue
-				case <-ctx.Done():
-					return ctx.Err()
+			wait = min(wait, remaining)
+		}
+		if err := s.lockBackoff.wait(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// TryLock attempts to acquire the lock for key without waiting. It returns
+// false if the lock is held by another holder, or true if it acquired the
+// lock, which must then be released with Unlock like the locks acquired
+// with Lock.
+func (s *Storage) TryLock(ctx context.Context, key string) (bool, error) {
+	if !s.tryEnterLockQueue(key) {
+		return false, nil
+	}
+	s.syncClock(ctx, s.objLockName(key))
+	holderCtx, _, err := s.acquireLock(ctx, key)
+	if holderCtx == nil {
+		s.leaveLockQueue(key)
+	}
+	if err != nil {
+		return false, err
+	}
+	return holderCtx != nil, nil
+}
+
+// acquireLock attempts to acquire the lock for key, taking it over if it
+// expired. It returns the context of the holder if it acquired the lock.
+// Otherwise contended reports whether the lock exists, with an error if it
+// could not be checked.
+func (s *Storage) acquireLock(ctx context.Context, key string) (holderCtx context.Context, contended bool, err error) {
+	for {
+		// The lock objects record who holds the lock, so that Unlock only
+		// releases our own lock
+		record, err := s.newLockRecord()
+		if err != nil {
+			return nil, false, err
+		}
+		
+		contended, err := s.acquireLockObjects(ctx, key, &record)
+		if errors.Is(err, errLockChanged) {
+			continue // Try to acquire the lock again
+		}
+		if contended || err != nil {
+			return nil, contended, err
+		}
+		return s.startLease(key, record), false, nil
+	}
+}
+
+// acquireLockObjects acquires the lock objects of the lock on key in turn
+// with record. If one of them cannot be acquired, those already acquired
+// are released.
+func (s *Storage) acquireLockObjects(ctx context.Context, key string, record *lockRecord) (contended bool, err error) {
+	lockKeys := s.lockObjects(key)
+	for i, lockKey := range lockKeys {
+		contended, err = s.acquireLockObject(ctx, lockKey, record)
+		if contended || err != nil {
+			for _, acquired := range lockKeys[:i] {
+				if err := s.releaseLock(context.Background(), key, acquired, record.Token); err != nil {
+					s.logger.Warn("releasing lock", zap.String("lock", acquired), zap.Error(err))
 				}
 			}
-			
-			// Lock exists and hasn't expired, wait and try again
-			select {
-			case <-time.After(LockPollInterval):
-				continue // Try again
-			case <-ctx.Done():
-				return ctx.Err()
-			}
+			return contended, err
 		}
-		
-		// For other errors, return the error
-		return fmt.Errorf("creating lock %s: %w", lockKey, err)
 	}
+	return false, nil
+}
+
+// acquireLockObject attempts to create the lock object lockKey with record,
+// or to take it over if it expired. It returns errLockChanged if the lock
+// object changed concurrently, and should be acquired again with a new
+// record.
+func (s *Storage) acquireLockObject(ctx context.Context, lockKey string, record *lockRecord) (contended bool, err error) {
+	// Try to create the lock object atomically using ForbidOverwrite header
+	// This will only succeed if the object doesn't already exist
+	err = s.writeLock(ctx, lockKey, *record, true)
+	
+	// If we successfully created the lock, return
+	if err == nil {
+		return false, nil
+	}
+	
+	// For errors other than an existing lock, return the error
+	if !isAlreadyExists(err) {
+		return false, fmt.Errorf("creating lock %s: %w", lockKey, err)
+	}
+	
+	// Lock already exists, check if it has expired
+	state, err := s.readLock(ctx, lockKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, errLockChanged // released in the meantime
+	}
+	if err != nil {
+		return true, err
+	}
+	
+	// Check if the lock has expired, according to the clock of the server
+	if !state.expired(s.lockExpiration) {
+		return true, nil
+	}
+	
+	// Lock has expired, take it over unless another contender does
+	record.Fence = max(record.Fence, s.nextFence(state.record.Fence))
+	err = s.transitionLock(ctx, lockKey, state, func(current lockState) error {
+		if !current.expired(s.lockExpiration) {
+			return errLockChanged
+		}
+		return nil
+	}, func(ctx context.Context) error {
+		return s.writeLock(ctx, lockKey, *record, false)
+	})
+	if err != nil && !errors.Is(err, errLockChanged) {
+		return true, err
+	}
+	return false, err
 }
 
 // Unlock releases the lock for key. This method must ONLY be
 // called after a successful call to Lock, and only after the
 // critical section is finished, even if it errored or timed
 // out. Unlock cleans up any resources allocated during Lock.
+//
+// The lock object is only released if it still carries the token written
+// by our Lock; otherwise ErrLockNotHeld is returned, as the lock expired and
+// was taken over by another holder. The release is guarded by a claim like
+// takeovers (see transitionLock). With LockPrefix, it keeps the lock
+// object, marked as released, for the fencing token of the next
+// acquisition (see keepsLockObject).
+//
+// Unlock releases the lock currently held by s on key, whichever goroutine
+// of s acquired it. If the lease of the lock expired and another goroutine
+// of s took the lock over, its former holder can call Unlock with the
+// context returned by LockContext, or one derived from it: Unlock then
+// returns ErrLockNotHeld without touching the lock of the new holder.
 func (s *Storage) Unlock(ctx context.Context, key string) error {
-	lockKey := s.objLockName(key)
+	lease, superseded := s.releaseLease(ctx, key)
+	if superseded {
+		return fmt.Errorf("unlocking %s: %w: lease expired and the lock was taken over", key, ErrLockNotHeld)
+	}
+	var token string
+	if lease != nil {
+		lease.end(context.Canceled)
+		defer s.leaveLockQueue(key)
+		token = lease.token
+	}
 	
-	// Delete the lock object
 	// We use a background context to ensure we can delete the lock even if the original context is cancelled
 	// This is important for cleanup operations
-	deleteCtx := context.Background()
-	_, err := s.client.DeleteObject(deleteCtx, &oss.DeleteObjectRequest{
-		Bucket: oss.Ptr(s.bucketName),
-		Key:    oss.Ptr(lockKey),
-	})
-	
+	var errs []error
+	for _, lockKey := range s.lockObjects(key) {
+		err := s.releaseLock(context.Background(), key, lockKey, token)
+		if errors.Is(err, ErrLockNotHeld) {
+			err = fmt.Errorf("unlocking %s: %w", key, err)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// releaseLock releases the lock object lockKey of the lock on key if it
+// carries token (see releaseLockObject). It returns ErrLockNotHeld if it
+// carries another token, or if token is empty.
+func (s *Storage) releaseLock(ctx context.Context, key, lockKey, token string) error {
+	state, err := s.readLock(ctx, lockKey)
+	if errors.Is(err, fs.ErrNotExist) || err == nil && state.record.Released {
+		return nil
+	}
 	if err != nil {
-		if isNotFound(err) {
+		return err
+	}
+	if token == "" || state.record.Token != token {
+		return fmt.Errorf("%w: held by %s", ErrLockNotHeld, state.record)
+	}
+	
+	// Release the lock object, unless it is being taken over
+	err = s.transitionLock(ctx, lockKey, state, func(current lockState) error {
+		if current.record.Token != token {
+			return errLockChanged
+		}
+		return nil
+	}, func(ctx context.Context) error {
+		return s.releaseLockObject(ctx, key, lockKey, state.record)
+	})
+	if errors.Is(err, errLockChanged) {
+		state, err = s.readLock(ctx, lockKey)
+		if errors.Is(err, fs.ErrNotExist) || err == nil && state.record.Released {
 			return nil
 		}
-		return fmt.Errorf("deleting lock %s: %w", lockKey, err)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: held by %s", ErrLockNotHeld, state.record)
 	}
-	
-	return nil
+	return err
 }
 
-func (s *Storage) objLockName(key string) string {
-	return key + ".lock"
+// objName returns the name of the object of key, within the prefix of s.
+func (s *Storage) objName(key string) string {
+	return s.prefix + key
 }
 
 // isNotFound checks whether the error indicates that an OSS object does not exist.
@@ -2,14 +2,19 @@ package storage
 
 import (
 	"context"
+	"crypto/md5"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"io/fs"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,6 +24,7 @@ import (
 	"github.com/google/tink/go/keyset"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 const testBucket = "test-bucket"
@@ -27,17 +33,42 @@ const testBucket = "test-bucket"
 type mockObject struct {
 	data         []byte
 	lastModified time.Time
+	etag         string
+	headers      http.Header // x-oss-meta-* and x-oss-server-side-encryption* headers
+}
+
+// writeHeaders sets the headers describing obj on a GET or HEAD response.
+func (obj *mockObject) writeHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(obj.data)))
+	w.Header().Set("Last-Modified", obj.lastModified.Format(http.TimeFormat))
+	w.Header().Set("ETag", obj.etag)
+	for name, values := range obj.headers {
+		w.Header()[name] = values
+	}
 }
 
 // mockOSSServer creates an httptest.Server that simulates the Alibaba Cloud OSS API.
 // It uses path-style URLs: /{bucket}/{key}
 func mockOSSServer(t *testing.T) *httptest.Server {
 	t.Helper()
+	return mockOSSServerWithClock(t, time.Now)
+}
 
+// mockOSSServerWithClock is mockOSSServer with the server clock given by
+// now, which sets the Date header of the responses and the LastModified time
+// of the objects.
+func mockOSSServerWithClock(t *testing.T, now func() time.Time) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(mockOSSHandler(now))
+}
+
+// mockOSSHandler returns the handler of mockOSSServerWithClock.
+func mockOSSHandler(now func() time.Time) http.Handler {
 	var mu sync.Mutex
 	objects := make(map[string]*mockObject) // key -> object
+	var bucketEncryption []byte             // ServerSideEncryptionRule XML
 
-	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		mu.Lock()
 		defer mu.Unlock()
 
@@ -56,6 +87,26 @@ func mockOSSServer(t *testing.T) *httptest.Server {
 		}
 
 		_ = bucket // we only have one bucket in tests
+		w.Header().Set("Date", now().UTC().Format(http.TimeFormat))
+
+		if _, ok := r.URL.Query()["encryption"]; ok && key == "" {
+			switch r.Method {
+			case http.MethodPut:
+				bucketEncryption, _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusOK)
+			case http.MethodGet:
+				if bucketEncryption == nil {
+					w.WriteHeader(http.StatusNotFound)
+					writeOSSError(w, "NoSuchServerSideEncryptionRule", "The bucket has no encryption configuration.")
+					return
+				}
+				w.Header().Set("Content-Type", "application/xml")
+				_, _ = w.Write(bucketEncryption)
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+			return
+		}
 
 		switch r.Method {
 		case http.MethodPut:
@@ -72,18 +123,27 @@ func mockOSSServer(t *testing.T) *httptest.Server {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
-			objects[key] = &mockObject{
+			headers := make(http.Header)
+			for name, values := range r.Header {
+				lname := strings.ToLower(name)
+				if strings.HasPrefix(lname, "x-oss-meta-") || strings.HasPrefix(lname, "x-oss-server-side-encryption") {
+					headers[name] = values
+				}
+			}
+			obj := &mockObject{
 				data:         data,
-				lastModified: time.Now().UTC(),
+				lastModified: now().UTC(),
+				etag:         fmt.Sprintf("\"%X\"", md5.Sum(data)),
+				headers:      headers,
 			}
+			objects[key] = obj
+			w.Header().Set("ETag", obj.etag)
 			w.WriteHeader(http.StatusOK)
 
 		case http.MethodGet:
 			// Check if this is a list request
 			if r.URL.Query().Get("list-type") == "2" {
-				prefix := r.URL.Query().Get("prefix")
-				delimiter := r.URL.Query().Get("delimiter")
-				handleListV2(w, objects, prefix, delimiter)
+				handleListV2(w, objects, r.URL.Query())
 				return
 			}
 
@@ -93,8 +153,7 @@ func mockOSSServer(t *testing.T) *httptest.Server {
 				writeOSSError(w, "NoSuchKey", "The specified key does not exist.")
 				return
 			}
-			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(obj.data)))
-			w.Header().Set("Last-Modified", obj.lastModified.Format(http.TimeFormat))
+			obj.writeHeaders(w)
 			w.WriteHeader(http.StatusOK)
 			_, _ = w.Write(obj.data)
 
@@ -102,20 +161,26 @@ func mockOSSServer(t *testing.T) *httptest.Server {
 			delete(objects, key)
 			w.WriteHeader(http.StatusNoContent)
 
+		case http.MethodPost:
+			if _, ok := r.URL.Query()["delete"]; !ok {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			handleDeleteMultipleObjects(w, r, objects)
+
 		case http.MethodHead:
 			obj, exists := objects[key]
 			if !exists {
 				w.WriteHeader(http.StatusNotFound)
 				return
 			}
-			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(obj.data)))
-			w.Header().Set("Last-Modified", obj.lastModified.Format(http.TimeFormat))
+			obj.writeHeaders(w)
 			w.WriteHeader(http.StatusOK)
 
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
-	}))
+	})
 }
 
 func writeOSSError(w http.ResponseWriter, code, message string) {
@@ -136,6 +201,7 @@ type listBucketResult struct {
 	KeyCount              int            `xml:"KeyCount"`
 	MaxKeys               int            `xml:"MaxKeys"`
 	IsTruncated           bool           `xml:"IsTruncated"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
 	Contents              []listObject   `xml:"Contents"`
 	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
 }
@@ -150,51 +216,133 @@ type commonPrefix struct {
 	Prefix string `xml:"Prefix"`
 }
 
-func handleListV2(w http.ResponseWriter, objects map[string]*mockObject, prefix, delimiter string) {
+// handleListV2 lists the objects like ListObjectsV2, in pages of max-keys
+// objects and common prefixes. The continuation token is the last key or
+// common prefix of the previous page.
+func handleListV2(w http.ResponseWriter, objects map[string]*mockObject, query url.Values) {
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	maxKeys, err := strconv.Atoi(query.Get("max-keys"))
+	if err != nil || maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	after := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		after = token
+	}
+
 	result := listBucketResult{
 		Name:    testBucket,
 		Prefix:  prefix,
-		MaxKeys: 1000,
+		MaxKeys: maxKeys,
 	}
 
-	seenPrefixes := make(map[string]bool)
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-	for key, obj := range objects {
+	var last string
+	for _, key := range keys {
 		if !strings.HasPrefix(key, prefix) {
 			continue
 		}
 
+		entry := key
 		if delimiter != "" {
 			// Check for common prefixes
 			rest := key[len(prefix):]
-			idx := strings.Index(rest, delimiter)
-			if idx >= 0 {
-				cp := prefix + rest[:idx+1]
-				if !seenPrefixes[cp] {
-					seenPrefixes[cp] = true
-					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: cp})
-				}
-				continue
+			if idx := strings.Index(rest, delimiter); idx >= 0 {
+				entry = prefix + rest[:idx+len(delimiter)]
 			}
 		}
+		if entry <= after || entry == last {
+			continue
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = last
+			break
+		}
 
-		result.Contents = append(result.Contents, listObject{
-			Key:          key,
-			LastModified: obj.lastModified.Format(time.RFC3339),
-			Size:         len(obj.data),
-		})
+		if entry != key {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: entry})
+		} else {
+			obj := objects[key]
+			result.Contents = append(result.Contents, listObject{
+				Key:          key,
+				LastModified: obj.lastModified.Format(time.RFC3339),
+				Size:         len(obj.data),
+			})
+		}
+		result.KeyCount++
+		last = entry
 	}
 
-	result.KeyCount = len(result.Contents)
 	w.Header().Set("Content-Type", "application/xml")
 	_ = xml.NewEncoder(w).Encode(result)
 }
 
+// deleteRequest is the XML request of DeleteMultipleObjects.
+type deleteRequest struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+// deleteResult is the XML response of DeleteMultipleObjects.
+type deleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Deleted []struct {
+		Key string `xml:"Key"`
+	} `xml:"Deleted"`
+}
+
+// handleDeleteMultipleObjects deletes the objects of the request, which
+// OSS reports as deleted whether they existed or not.
+func handleDeleteMultipleObjects(w http.ResponseWriter, r *http.Request, objects map[string]*mockObject) {
+	var request deleteRequest
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Objects) > 1000 {
+		w.WriteHeader(http.StatusBadRequest)
+		writeOSSError(w, "MalformedXML", "The XML you provided was not well-formed.")
+		return
+	}
+	var result deleteResult
+	for _, object := range request.Objects {
+		delete(objects, object.Key)
+		result.Deleted = append(result.Deleted, struct {
+			Key string `xml:"Key"`
+		}{object.Key})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+// withMaxKeys limits the pages of objects listed by h to maxKeys entries.
+func withMaxKeys(h http.Handler, maxKeys int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if query := r.URL.Query(); query.Get("list-type") == "2" {
+			query.Set("max-keys", strconv.Itoa(maxKeys))
+			r.URL.RawQuery = query.Encode()
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 // setupTestStorage creates a Storage instance backed by a mock OSS server.
 func setupTestStorage(t *testing.T) (*Storage, *httptest.Server) {
 	t.Helper()
 	server := mockOSSServer(t)
+	t.Cleanup(func() { server.Close() })
+	return connectTestStorage(t, server, "test-instance"), server
+}
 
+// connectTestStorage creates another Storage instance, identified by
+// instanceID, backed by the mock OSS server.
+func connectTestStorage(t *testing.T, server *httptest.Server, instanceID string) *Storage {
+	t.Helper()
 	cfg := oss.LoadDefaultConfig().
 		WithCredentialsProvider(credentials.NewStaticCredentialsProvider("test-ak", "test-sk", "")).
 		WithRegion("test-region").
@@ -207,10 +355,10 @@ func setupTestStorage(t *testing.T) (*Storage, *httptest.Server) {
 		bucketName:     testBucket,
 		aead:           new(cleartext),
 		lockExpiration: DefaultLockExpiration,
+		logger:         zap.NewNop(),
+		instanceID:     instanceID,
 	}
-
-	t.Cleanup(func() { server.Close() })
-	return s, server
+	return s
 }
 
 func TestStore_Load_Exists_Stat_Delete(t *testing.T) {
@@ -264,6 +412,49 @@ func TestStat_NotFound(t *testing.T) {
 	assert.ErrorIs(t, err, fs.ErrNotExist)
 }
 
+func TestStat_Directory(t *testing.T) {
+	clock := newFakeClock()
+	server := httptest.NewServer(withMaxKeys(mockOSSHandler(clock.Now), 1))
+	t.Cleanup(server.Close)
+	s := connectTestStorage(t, server, "test-instance")
+	ctx := context.Background()
+
+	dir := "certificates/acme-v02.api.letsencrypt.org-directory"
+	require.NoError(t, s.Store(ctx, dir+"/example.com/example.com.crt", []byte("cert")))
+	clock.Add(time.Hour)
+	require.NoError(t, s.Store(ctx, dir+"/example.com/example.com.key", []byte("private key")))
+	clock.Add(time.Hour)
+	require.NoError(t, s.Store(ctx, dir+"/sub.example.com/sub.example.com.crt", []byte("sub cert")))
+	require.NoError(t, s.Store(ctx, "certificates/acme-v02.api.letsencrypt.org-directory.json", []byte("not beneath")))
+
+	tests := []struct {
+		key      string
+		size     int64
+		modified time.Time
+	}{
+		{dir, 4 + 11 + 8, clock.Now()},
+		{dir + "/", 4 + 11 + 8, clock.Now()},
+		{dir + "/example.com", 4 + 11, clock.Now().Add(-time.Hour)},
+	}
+	for _, tt := range tests {
+		info, err := s.Stat(ctx, tt.key)
+		require.NoError(t, err, tt.key)
+		assert.Equal(t, tt.key, info.Key)
+		assert.False(t, info.IsTerminal, tt.key)
+		assert.Equal(t, tt.size, info.Size, tt.key)
+		assert.True(t, tt.modified.Equal(info.Modified), "%s modified %s", tt.key, info.Modified)
+	}
+
+	info, err := s.Stat(ctx, dir+"/example.com/example.com.crt")
+	require.NoError(t, err)
+	assert.True(t, info.IsTerminal)
+
+	for _, key := range []string{"certificates/acme", dir + "/example", "missing/"} {
+		_, err := s.Stat(ctx, key)
+		assert.ErrorIs(t, err, fs.ErrNotExist, key)
+	}
+}
+
 func TestDelete_NotFound_ReturnsNil(t *testing.T) {
 	s, _ := setupTestStorage(t)
 	ctx := context.Background()
@@ -324,6 +515,101 @@ func TestList_NonRecursive(t *testing.T) {
 	}
 }
 
+func TestList(t *testing.T) {
+	keys := []string{
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.crt",
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.json",
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.key",
+		"certificates/acme-v02.api.letsencrypt.org-directory/sub.example.com/sub.example.com.crt",
+		"certificates/zerossl/example.net/example.net.crt",
+		"last_clean.json",
+		"ocsp/example.com-0123",
+		"ocsp/example.com-4567",
+		"ocsp2/example.org-89ab",
+	}
+
+	tests := []struct {
+		name      string
+		prefix    string
+		recursive bool
+		want      []string
+	}{
+		{
+			name:   "root",
+			prefix: "",
+			want:   []string{"certificates", "last_clean.json", "ocsp", "ocsp2"},
+		},
+		{
+			name:   "directory",
+			prefix: "certificates",
+			want:   []string{"certificates/acme-v02.api.letsencrypt.org-directory", "certificates/zerossl"},
+		},
+		{
+			name:   "directory with trailing slash",
+			prefix: "certificates/acme-v02.api.letsencrypt.org-directory/",
+			want: []string{
+				"certificates/acme-v02.api.letsencrypt.org-directory/example.com",
+				"certificates/acme-v02.api.letsencrypt.org-directory/sub.example.com",
+			},
+		},
+		{
+			name:   "terminal keys",
+			prefix: "certificates/acme-v02.api.letsencrypt.org-directory/example.com",
+			want: []string{
+				"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.crt",
+				"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.json",
+				"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.key",
+			},
+		},
+		{
+			name:   "directory is not a key prefix",
+			prefix: "ocsp",
+			want:   []string{"ocsp/example.com-0123", "ocsp/example.com-4567"},
+		},
+		{
+			name:   "missing directory",
+			prefix: "missing",
+			want:   nil,
+		},
+		{
+			name:      "recursive",
+			prefix:    "certificates/",
+			recursive: true,
+			want:      keys[:5],
+		},
+		{
+			name:      "recursive directory is not a key prefix",
+			prefix:    "ocsp",
+			recursive: true,
+			want:      keys[6:8],
+		},
+		{
+			name:      "recursive root",
+			prefix:    "",
+			recursive: true,
+			want:      keys,
+		},
+	}
+
+	for _, maxKeys := range []int{1, 2, 1000} {
+		server := httptest.NewServer(withMaxKeys(mockOSSHandler(time.Now), maxKeys))
+		t.Cleanup(server.Close)
+		s := connectTestStorage(t, server, "test-instance")
+		ctx := context.Background()
+		for _, key := range keys {
+			require.NoError(t, s.Store(ctx, key, []byte("data")))
+		}
+
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/max-keys=%d", tt.name, maxKeys), func(t *testing.T) {
+				got, err := s.List(ctx, tt.prefix, tt.recursive)
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			})
+		}
+	}
+}
+
 func TestEncryption(t *testing.T) {
 	s, _ := setupTestStorage(t)
 	ctx := context.Background()
@@ -432,8 +718,9 @@ func TestLock_ContextCancellation(t *testing.T) {
 func TestLock_ExpiredLock_Reacquired(t *testing.T) {
 	s, _ := setupTestStorage(t)
 
-	// Make lock expire almost immediately
+	// Make lock expire almost immediately, as if its holder crashed
 	s.lockExpiration = 50 * time.Millisecond
+	s.lockRenewInterval = -1
 	origPoll := LockPollInterval
 	LockPollInterval = 20 * time.Millisecond
 	defer func() {
@@ -466,6 +753,78 @@ func TestUnlock_NotLocked_ReturnsNil(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+// withFailingHeads makes the first failures HEAD requests of h fail with
+// status, and counts the HEAD requests.
+func withFailingHeads(h http.Handler, status, failures int, heads *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && int(heads.Add(1)) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withFastExistsRetries shortens the interval between the attempts of
+// Exists for the duration of the test.
+func withFastExistsRetries(t *testing.T) {
+	interval := existsRetryInterval
+	existsRetryInterval = time.Millisecond
+	t.Cleanup(func() { existsRetryInterval = interval })
+}
+
+func TestExistsE(t *testing.T) {
+	var heads atomic.Int32
+	server := httptest.NewServer(withFailingHeads(mockOSSHandler(time.Now), http.StatusForbidden, 1, &heads))
+	t.Cleanup(server.Close)
+	s := connectTestStorage(t, server, "test-instance")
+	ctx := context.Background()
+	require.NoError(t, s.Store(ctx, "example.com.crt", []byte("cert")))
+
+	_, err := s.ExistsE(ctx, "example.com.crt")
+	var serviceErr *oss.ServiceError
+	require.ErrorAs(t, err, &serviceErr)
+	assert.Equal(t, http.StatusForbidden, serviceErr.StatusCode)
+
+	exists, err := s.ExistsE(ctx, "example.com.crt")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = s.ExistsE(ctx, "missing.crt")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestExists_RetriesErrors(t *testing.T) {
+	withFastExistsRetries(t)
+	var heads atomic.Int32
+	server := httptest.NewServer(withFailingHeads(mockOSSHandler(time.Now), http.StatusForbidden, existsAttempts-1, &heads))
+	t.Cleanup(server.Close)
+	s := connectTestStorage(t, server, "test-instance")
+	ctx := context.Background()
+	require.NoError(t, s.Store(ctx, "example.com.crt", []byte("cert")))
+
+	assert.True(t, s.Exists(ctx, "example.com.crt"))
+	assert.EqualValues(t, existsAttempts, heads.Load())
+
+	// A missing key is not retried.
+	heads.Store(int32(existsAttempts))
+	assert.False(t, s.Exists(ctx, "missing.crt"))
+	assert.EqualValues(t, existsAttempts+1, heads.Load())
+}
+
+func TestExists_KeepsFailing(t *testing.T) {
+	withFastExistsRetries(t)
+	var heads atomic.Int32
+	server := httptest.NewServer(withFailingHeads(mockOSSHandler(time.Now), http.StatusForbidden, 100, &heads))
+	t.Cleanup(server.Close)
+	s := connectTestStorage(t, server, "test-instance")
+	ctx := context.Background()
+	require.NoError(t, s.Store(ctx, "example.com.crt", []byte("cert")))
+
+	assert.False(t, s.Exists(ctx, "example.com.crt"))
+	assert.EqualValues(t, existsAttempts, heads.Load())
+}
+
 func TestIsNotFound(t *testing.T) {
 	// Test with NoSuchKey error code
 	err1 := &oss.ServiceError{}
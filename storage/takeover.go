@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"go.uber.org/zap"
+)
+
+// lockClaimExpiration is the duration after which a claim on a lock object
+// is considered abandoned by its claimant.
+var lockClaimExpiration = 30 * time.Second
+
+// errLockChanged is returned by transitionLock when the lock object changed
+// since it was read, or another contender is changing it.
+var errLockChanged = errors.New("lock changed concurrently")
+
+// lockClaimInfix separates the name of a lock object from the version and
+// number of a claim on it.
+const lockClaimInfix = ".claim-"
+
+// lockClaimName returns the name of the n-th claim on the version of the
+// lock object lockKey with the given ETag.
+func lockClaimName(lockKey, etag string, n int) string {
+	return fmt.Sprintf("%s%s%s-%d", lockKey, lockClaimInfix, strings.Trim(etag, `"`), n)
+}
+
+// parseLockClaimName returns the lock object and the ETag of the version of
+// the lock object claimed by the claim claimKey, if it is a claim.
+func parseLockClaimName(claimKey string) (lockKey, etag string, ok bool) {
+	i := strings.LastIndex(claimKey, lockSuffix+lockClaimInfix)
+	if i < 0 {
+		return "", "", false
+	}
+	lockKey = claimKey[:i+len(lockSuffix)]
+	rest := claimKey[i+len(lockSuffix+lockClaimInfix):]
+	j := strings.LastIndex(rest, "-")
+	if j < 0 {
+		return "", "", false
+	}
+	if _, err := strconv.Atoi(rest[j+1:]); err != nil {
+		return "", "", false
+	}
+	return lockKey, rest[:j], true
+}
+
+// isLockObject reports whether key is a lock object or a claim on one.
+func isLockObject(key string) bool {
+	return strings.HasSuffix(key, lockSuffix) || strings.Contains(key, lockSuffix+lockClaimInfix)
+}
+
+// transitionLock replaces the lock object lockKey, as read in state, by
+// calling apply, provided that check still accepts the lock object once
+// claimed and that no other transition from the same version of the lock
+// object happens concurrently.
+//
+// OSS has no conditional PutObject or DeleteObject: every transition of a
+// lock object (takeover, renewal or release) therefore first creates a claim
+// object for the version of the lock object it starts from, identified by
+// its ETag, with ForbidOverwrite. Only the contender that creates the claim
+// applies the transition, after reading the lock object again to check that
+// it is still at that version. Lock records contain a random token, so a
+// version is never seen twice.
+//
+// If a claimant does not complete within lockClaimExpiration, e.g. because it
+// crashed, the next claim, numbered n+1, can be created by another
+// contender. A claimant which finds claim n+1 after applying its transition
+// may have been overtaken and returns errLockChanged. Claims n > 1 are left
+// behind for stale claimants to find them.
+func (s *Storage) transitionLock(ctx context.Context, lockKey string, state lockState,
+	check func(lockState) error, apply func(context.Context) error) error {
+	n, err := s.claimLock(ctx, lockKey, state.etag)
+	if err != nil {
+		return err
+	}
+	if n == 1 {
+		defer s.deleteObject(context.Background(), lockClaimName(lockKey, state.etag, n))
+	}
+
+	current, err := s.readLock(ctx, lockKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return errLockChanged
+	}
+	if err != nil {
+		return err
+	}
+	if current.etag != state.etag {
+		return errLockChanged
+	}
+	if err := check(current); err != nil {
+		return err
+	}
+
+	if err := apply(ctx); err != nil {
+		return err
+	}
+
+	_, err = s.client.HeadObject(ctx, &oss.HeadObjectRequest{
+		Bucket: oss.Ptr(s.bucketName),
+		Key:    oss.Ptr(s.objName(lockClaimName(lockKey, state.etag, n+1))),
+	})
+	if err == nil {
+		// Our claim was deemed abandoned: the next claimant may have
+		// applied its own transition.
+		return errLockChanged
+	}
+	if !isNotFound(err) {
+		return fmt.Errorf("checking claims on lock %s: %w", lockKey, err)
+	}
+	return nil
+}
+
+// claimLock creates the first available claim on the version etag of the
+// lock object lockKey and returns its number. It returns errLockChanged if a
+// live claim exists.
+func (s *Storage) claimLock(ctx context.Context, lockKey, etag string) (int, error) {
+	for n := 1; ; n++ {
+		claimKey := lockClaimName(lockKey, etag, n)
+		record, err := s.newLockRecord()
+		if err != nil {
+			return 0, err
+		}
+		record.ExpiresAt = record.AcquiredAt.Add(lockClaimExpiration)
+		err = s.writeLock(ctx, claimKey, record, true)
+		if err == nil {
+			return n, nil
+		}
+		if !isAlreadyExists(err) {
+			return 0, fmt.Errorf("claiming lock %s: %w", lockKey, err)
+		}
+
+		claim, err := s.readLock(ctx, claimKey)
+		if errors.Is(err, fs.ErrNotExist) {
+			// the claimant completed its transition
+			return 0, errLockChanged
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !claim.expired(lockClaimExpiration) {
+			return 0, errLockChanged
+		}
+		s.logger.Warn("lock claim abandoned",
+			zap.String("claim", claimKey),
+			zap.String("owner", claim.record.Owner))
+	}
+}
+
+// deleteObject deletes key, logging failures other than a missing object.
+func (s *Storage) deleteObject(ctx context.Context, key string) {
+	_, err := s.client.DeleteObject(ctx, &oss.DeleteObjectRequest{
+		Bucket: oss.Ptr(s.bucketName),
+		Key:    oss.Ptr(s.objName(key)),
+	})
+	if err != nil && !isNotFound(err) {
+		s.logger.Warn("deleting object", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// isAlreadyExists reports whether err is the failure of a PutObject with
+// ForbidOverwrite because the object exists.
+func isAlreadyExists(err error) bool {
+	var serviceErr *oss.ServiceError
+	if !errors.As(err, &serviceErr) {
+		return false
+	}
+	switch serviceErr.ErrorCode() {
+	case "PreconditionFailed", "ObjectAlreadyExists", "FileAlreadyExists":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeExpiredLock writes a lock on key held by a crashed instance, expired
+// for a minute.
+func writeExpiredLock(t *testing.T, s *Storage, key string) lockState {
+	t.Helper()
+	ctx := context.Background()
+	record, err := s.newLockRecord()
+	require.NoError(t, err)
+	record.Owner = "crashed"
+	record.ExpiresAt = record.AcquiredAt.Add(-time.Minute)
+	require.NoError(t, s.writeLock(ctx, s.objLockName(key), record, true))
+	state, err := s.readLock(ctx, s.objLockName(key))
+	require.NoError(t, err)
+	return state
+}
+
+// withJitter delays every request by up to max, to shuffle the requests of
+// concurrent clients.
+func withJitter(h http.Handler, max time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(rand.Int64N(int64(max))))
+		h.ServeHTTP(w, r)
+	})
+}
+
+func TestLock_ConcurrentTakeover(t *testing.T) {
+	server := httptest.NewServer(withJitter(mockOSSHandler(time.Now), 5*time.Millisecond))
+	t.Cleanup(server.Close)
+	const contenders = 8
+	var storages []*Storage
+	for i := 0; i < contenders; i++ {
+		s := connectTestStorage(t, server, fmt.Sprintf("instance-%d", i))
+		s.lockRenewInterval = -1
+		storages = append(storages, s)
+	}
+
+	for round := 0; round < 10; round++ {
+		key := fmt.Sprintf("round-%d", round)
+		writeExpiredLock(t, storages[0], key)
+
+		// All contenders find the same expired lock at the same time: exactly
+		// one of them may take it over.
+		var (
+			wg      sync.WaitGroup
+			start   = make(chan struct{})
+			mu      sync.Mutex
+			winners []string
+		)
+		for _, s := range storages {
+			wg.Add(1)
+			go func(s *Storage) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+				defer cancel()
+				<-start
+				if err := s.Lock(ctx, key); err == nil {
+					mu.Lock()
+					winners = append(winners, s.instanceID)
+					mu.Unlock()
+				}
+			}(s)
+		}
+		close(start)
+		wg.Wait()
+
+		require.Len(t, winners, 1, "round %d: %v", round, winners)
+		state, err := storages[0].readLock(context.Background(), storages[0].objLockName(key))
+		require.NoError(t, err)
+		assert.Equal(t, winners[0], state.record.Owner)
+	}
+}
+
+func TestTransitionLock_AbandonedClaim(t *testing.T) {
+	origPoll := LockPollInterval
+	LockPollInterval = 10 * time.Millisecond
+	defer func() { LockPollInterval = origPoll }()
+
+	local := newFakeClock()
+	a, b := setupSkewedStorages(t, local, 0)
+	ctx := context.Background()
+	lockKey := a.objLockName("example.com")
+	state := writeExpiredLock(t, a, "example.com")
+
+	// a claimed the expired lock, then crashed.
+	n, err := a.claimLock(ctx, lockKey, state.etag)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, b.Lock(timeoutCtx, "example.com"), context.DeadlineExceeded)
+
+	local.Add(lockClaimExpiration + time.Second)
+	require.NoError(t, b.Lock(ctx, "example.com"))
+
+	// The claims stay, for a to find them if it resumes.
+	assert.True(t, b.Exists(ctx, lockClaimName(lockKey, state.etag, 1)))
+	assert.True(t, b.Exists(ctx, lockClaimName(lockKey, state.etag, 2)))
+}
+
+func TestTransitionLock_OvertakenClaimant(t *testing.T) {
+	a, server := setupTestStorage(t)
+	b := connectTestStorage(t, server, "instance-b")
+	ctx := context.Background()
+	lockKey := a.objLockName("example.com")
+	state := writeExpiredLock(t, a, "example.com")
+
+	// b deemed a's claim abandoned and created the next one.
+	record, err := b.newLockRecord()
+	require.NoError(t, err)
+	require.NoError(t, b.writeLock(ctx, lockClaimName(lockKey, state.etag, 2), record, true))
+
+	applied := false
+	err = a.transitionLock(ctx, lockKey, state, func(lockState) error { return nil }, func(context.Context) error {
+		applied = true
+		return nil
+	})
+	assert.True(t, applied)
+	assert.ErrorIs(t, err, errLockChanged, "a must not believe it holds the lock")
+	assert.False(t, a.Exists(ctx, lockClaimName(lockKey, state.etag, 1)), "first claim is cleaned up")
+}
+
+func TestTransitionLock_ChangedLock(t *testing.T) {
+	s, _ := setupTestStorage(t)
+	ctx := context.Background()
+	lockKey := s.objLockName("example.com")
+	state := writeExpiredLock(t, s, "example.com")
+
+	// The lock object was renewed since it was read.
+	record := state.record
+	record.ExpiresAt = record.ExpiresAt.Add(time.Hour)
+	require.NoError(t, s.writeLock(ctx, lockKey, record, false))
+
+	err := s.transitionLock(ctx, lockKey, state, func(lockState) error { return nil }, func(context.Context) error {
+		t.Fatal("transition applied to a changed lock")
+		return nil
+	})
+	assert.ErrorIs(t, err, errLockChanged)
+	assert.False(t, s.Exists(ctx, lockClaimName(lockKey, state.etag, 1)))
+}
+
+func TestIsLockObject(t *testing.T) {
+	assert.True(t, isLockObject("certs/example.com.lock"))
+	assert.True(t, isLockObject(lockClaimName("certs/example.com.lock", `"ABCDEF"`, 2)))
+	assert.False(t, isLockObject("certs/example.com.crt"))
+	assert.False(t, isLockObject("certs/example.lockfile"))
+}